@@ -22,6 +22,7 @@ func main() {
 		"networkusage":        &plugins.NetworkUsageMonitor{},
 		"networkavailability": &plugins.NetworkAvailability{},
 		"pwmstatus":           &plugins.PwmGauge{},
+		"networkinterfaces":   &plugins.NetworkInterfaces{},
 	}
 
 	var plugin, exists = pluginMap[pluginName]
@@ -38,7 +39,8 @@ func main() {
 	plugin.Start()
 	var path = fmt.Sprintf("/%s", pluginName)
 	logger.Printf("registering handler at %s", path)
-	http.Handle(path, plugin)
+	http.Handle(path, http.StripPrefix(path, plugin))
+	http.Handle(path+"/", http.StripPrefix(path, plugin))
 
 	http.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
 		http.Redirect(rw, req, path, http.StatusFound)
@@ -1,14 +1,17 @@
 package plugins
 
 import (
+	"bytes"
 	"fmt"
-	"encoding/json"
 	"garfield/rpi-api-server/utils"
 	"io"
-	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -21,104 +24,548 @@ const networkAvailabilityTargetLabel = "target"
 var networkAvailabilityLables = []string{networkAvailabilityTargetLabel}
 
 type NetworkAvailability struct {
-	logger                   *log.Logger
-	targets                  map[string]Target
-	ticker                   *time.Ticker
-	gaugeVec                 *prometheus.GaugeVec
-	lastTick                 time.Time
-	refreshIntervalInSeconds int
-	proxyUrlStr              string
-	httpClientWithProxy      *http.Client
+	logger                      *log.Logger
+	targetsFile                 string
+	targets                     map[string]Target
+	gaugeVec                    *prometheus.GaugeVec
+	lastTick                    time.Time
+	refreshIntervalInSeconds    int
+	retryIntervalInSeconds      int
+	jitterPercent               int
+	random                      *rand.Rand
+	nextChecks                  map[string]time.Time
+	wakeChan                    chan struct{}
+	throughputIntervalInSeconds int
+	throughputs                 map[string]ThroughputResult
+	nextThroughputChecks        map[string]time.Time
+	throughputGaugeVec          *prometheus.GaugeVec
+	proxyUrlStr                 string
+	proxyUrl                    *url.URL
+	httpClientWithProxy         *http.Client
+	diagnoseAllTargets          bool
+	diagnosisTimeout            time.Duration
+	checkTimeout                time.Duration
+	historySaveInterval         time.Duration
+	diagnosisPaths              []diagnosisPath
+	diagnoses                   map[string]Diagnosis
+	statuses                    map[string]TargetStatus
+	refreshMinInterval          time.Duration
+	lastRefresh                 time.Time
+	refreshChan                 chan chan struct{}
+	history                     *availabilityHistory
+	uptimeGaugeVec              *prometheus.GaugeVec
+	notifier                    *availabilityNotifier
+	certExpiryGaugeVec          *prometheus.GaugeVec
+	certValidGaugeVec           *prometheus.GaugeVec
+	certInfoGaugeVec            *prometheus.GaugeVec
+	probeModules                map[string]ProbeModule
+	lock                        sync.Mutex
+	pathGaugeVec                *prometheus.GaugeVec
+	diagnosisGaugeVec           *prometheus.GaugeVec
 }
 
 type Target struct {
 	Url       string `json:"url"`
 	NeedProxy bool   `json:"needProxy"`
+	Diagnose  bool   `json:"diagnose,omitempty"`
+	Paused    bool   `json:"paused,omitempty"`
+	// optional throughput test on its own schedule
+	Throughput *ThroughputConfig `json:"throughput,omitempty"`
+	// override RefreshIntervalInSeconds and RetryIntervalInSeconds when set
+	IntervalInSeconds      int `json:"intervalInSeconds,omitempty"`
+	RetryIntervalInSeconds int `json:"retryIntervalInSeconds,omitempty"`
+	// overrides CheckTimeoutInSeconds when set
+	TimeoutInSeconds int `json:"timeoutInSeconds,omitempty"`
+	// request customization, the method defaults to GET and redirects are followed unless disabled
+	Method             string            `json:"method,omitempty"`
+	Headers            map[string]string `json:"headers,omitempty"`
+	BasicAuth          *BasicAuth        `json:"basicAuth,omitempty"`
+	BearerTokenFile    string            `json:"bearerTokenFile,omitempty"`
+	Body               string            `json:"body,omitempty"`
+	CaFile             string            `json:"caFile,omitempty"`
+	InsecureSkipVerify bool              `json:"insecureSkipVerify,omitempty"`
+	FollowRedirects    *bool             `json:"followRedirects,omitempty"`
+	// any response is up unless set, like [200, 204], a 3xx is only seen when
+	// redirects are not followed
+	ValidStatusCodes []int `json:"validStatusCodes,omitempty"`
+	// override NotificationDownThreshold and NotificationRecoveryThreshold when set
+	DownThreshold     int `json:"downThreshold,omitempty"`
+	RecoveryThreshold int `json:"recoveryThreshold,omitempty"`
+}
+
+// latest result of a target, kept by the scheduler and served by the status page
+type TargetStatus struct {
+	Up                   bool               `json:"up"`
+	CheckedAt            time.Time          `json:"checkedAt"`
+	StatusCode           int                `json:"statusCode,omitempty"`
+	Error                string             `json:"error,omitempty"`
+	Latency              time.Duration      `json:"latency"`
+	ConsecutiveFailures  int                `json:"consecutiveFailures"`
+	ConsecutiveSuccesses int                `json:"consecutiveSuccesses"`
+	Certificate          *CertificateStatus `json:"certificate,omitempty"`
+}
+
+func (s TargetStatus) gaugeValue() float64 {
+	if s.Up {
+		return 1
+	}
+	return 0
 }
 
 func (n *NetworkAvailability) Start() {
 	n.logger = utils.GetLogger("NetworkAvailabilityGauge")
-	filePath := "targets.json"
-	jsonBytes, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		n.logger.Printf(err.Error())
-		return
-	}
-	n.logger.Printf(string(jsonBytes))
-	err = json.Unmarshal(jsonBytes, &n.targets)
-	if err != nil {
+	n.targetsFile = utils.GetEnvVarString("TargetsFile", "targets.json")
+	n.logger.Printf("targets file is %q", n.targetsFile)
+	var err = n.loadTargets()
+	if os.IsNotExist(err) {
+		n.logger.Printf("targets file not found, starting without targets")
+		n.targets = map[string]Target{}
+	} else if err != nil {
 		n.logger.Printf(err.Error())
 		return
 	}
 	for name, target := range n.targets {
-		n.logger.Printf("got target %s at %s with proxy %t", name, target.Url, target.NeedProxy)
+		n.logger.Printf("got target %s at %s with proxy %t, paused %t", name, redactUrl(target.Url), target.NeedProxy, target.Paused)
 	}
 
 	n.refreshIntervalInSeconds = utils.GetEnvVarInt("RefreshIntervalInSeconds", 300)
+	n.retryIntervalInSeconds = utils.GetEnvVarInt("RetryIntervalInSeconds", 60)
+	n.jitterPercent = utils.GetEnvVarInt("JitterPercent", 10)
+	n.checkTimeout = time.Duration(utils.GetEnvVarInt("CheckTimeoutInSeconds", 30)) * time.Second
 	n.proxyUrlStr = utils.GetEnvVarString("ProxyUrl", "://invalidURL")
 	proxyUrl, err := url.Parse(n.proxyUrlStr)
 	if err != nil {
 		n.logger.Printf("failed to parse proxy url %q: %s", n.proxyUrlStr, err)
 		n.httpClientWithProxy = nil
 	} else {
+		n.proxyUrl = proxyUrl
 		n.httpClientWithProxy = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
 	}
 
+	n.diagnoseAllTargets = utils.GetEnvVarBool("DiagnoseAllTargets", false)
+	n.diagnosisTimeout = time.Duration(utils.GetEnvVarInt("DiagnosisTimeoutInSeconds", 10)) * time.Second
+	var diagnosisResolvers = strings.Fields(utils.GetEnvVarString("DiagnosisResolvers", ""))
+	var diagnosisProxyUrls = []*url.URL{}
+	if n.httpClientWithProxy != nil {
+		diagnosisProxyUrls = append(diagnosisProxyUrls, proxyUrl)
+	}
+	for _, proxyUrlStr := range strings.Fields(utils.GetEnvVarString("DiagnosisProxyUrls", "")) {
+		var diagnosisProxyUrl, err = url.Parse(proxyUrlStr)
+		if err != nil {
+			n.logger.Printf("failed to parse diagnosis proxy url %q: %s", proxyUrlStr, err)
+			continue
+		}
+		diagnosisProxyUrls = append(diagnosisProxyUrls, diagnosisProxyUrl)
+	}
+	n.diagnosisPaths = buildDiagnosisPaths(diagnosisResolvers, diagnosisProxyUrls, n.diagnosisTimeout)
+	n.diagnoses = map[string]Diagnosis{}
+	n.logger.Printf("diagnose all targets: %t", n.diagnoseAllTargets)
+	for _, path := range n.diagnosisPaths {
+		n.logger.Printf("diagnosis path: %s", path.name)
+	}
+
 	n.logger.Printf("registering network availability gauge as %s", networkAvailabilityMetricName)
 	n.logger.Printf("refresh interval is %d seconds", n.refreshIntervalInSeconds)
+	n.logger.Printf("retry interval is %d seconds, jitter is %d%% of the interval", n.retryIntervalInSeconds, n.jitterPercent)
+	n.logger.Printf("check timeout is %s", n.checkTimeout)
 	n.logger.Printf("proxy url is %q", n.proxyUrlStr)
 
 	n.gaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: networkAvailabilityMetricName,
 		Help: "check network availability by http",
 	}, networkAvailabilityLables)
+	n.pathGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: networkAvailabilityPathMetricName,
+		Help: "check network availability of a target through each path",
+	}, networkAvailabilityPathLables)
+	n.diagnosisGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: networkAvailabilityDiagnosisMetricName,
+		Help: "classification of where a target fails, 1 for the current diagnosis",
+	}, networkAvailabilityDiagnosisLables)
 
-	n.ticker = time.NewTicker(time.Duration(n.refreshIntervalInSeconds) * time.Second)
-	go n.ticking()
+	n.refreshMinInterval = time.Duration(utils.GetEnvVarInt("RefreshMinIntervalInSeconds", 30)) * time.Second
+	n.logger.Printf("minimum interval between on-demand refreshes is %s", n.refreshMinInterval)
+	n.statuses = map[string]TargetStatus{}
+	var historyFile = utils.GetEnvVarString("HistoryFile", "availability_history.json")
+	var maxHistorySamples = utils.GetEnvVarInt("MaxHistorySamples", 10000)
+	n.historySaveInterval = time.Duration(utils.GetEnvVarInt("HistorySaveIntervalInSeconds", 300)) * time.Second
+	n.logger.Printf("history file is %q, keeping at most %d state changes per target, saved every %s", historyFile, maxHistorySamples, n.historySaveInterval)
+	n.history, err = loadAvailabilityHistory(historyFile, maxHistorySamples)
+	if err != nil {
+		n.logger.Printf("failed to load history from %q, starting empty: %s", historyFile, err)
+		n.history.samples = map[string][]HistorySample{}
+	}
+	n.uptimeGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: networkAvailabilityUptimeMetricName,
+		Help: "share of time a target was up over a window",
+	}, networkAvailabilityUptimeLables)
+	n.notifier = newAvailabilityNotifier()
+	n.logger.Printf("notification enabled: %t, down after %d failures, recovered after %d successes, min interval %s, digest %t",
+		n.notifier.pusher != nil, n.notifier.downThreshold, n.notifier.recoveryThreshold, n.notifier.minInterval, n.notifier.digest)
+	n.logger.Printf("warning %s before certificates expire", n.notifier.certWarningPeriod)
+	n.certExpiryGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: networkAvailabilityCertExpiryMetricName,
+		Help: "seconds until the leaf certificate of a https target expires",
+	}, networkAvailabilityCertLables)
+	n.certValidGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: networkAvailabilityCertValidMetricName,
+		Help: "if the certificate chain of a https target verifies",
+	}, networkAvailabilityCertLables)
+	n.certInfoGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: networkAvailabilityCertInfoMetricName,
+		Help: "issuer of the leaf certificate of a https target",
+	}, networkAvailabilityCertInfoLables)
+	var probeModulesFile = utils.GetEnvVarString("ProbeModulesFile", "probe_modules.json")
+	if err = n.loadProbeModules(probeModulesFile); err != nil {
+		n.logger.Printf("failed to load probe modules from %q, using defaults: %s", probeModulesFile, err)
+	}
+	for name, module := range n.probeModules {
+		n.logger.Printf("got probe module %s with prober %s", name, module.Prober)
+	}
+
+	n.nextChecks = map[string]time.Time{}
+	n.wakeChan = make(chan struct{}, 1)
+	n.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	n.throughputIntervalInSeconds = utils.GetEnvVarInt("ThroughputIntervalInSeconds", 3600)
+	n.logger.Printf("throughput interval is %d seconds", n.throughputIntervalInSeconds)
+	n.throughputs = map[string]ThroughputResult{}
+	n.nextThroughputChecks = map[string]time.Time{}
+	n.throughputGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: networkAvailabilityThroughputMetricName,
+		Help: "achieved throughput of the last throughput test of a target",
+	}, networkAvailabilityThroughputLables)
+	// left nil when Start returned early, refreshes are then rejected
+	n.refreshChan = make(chan chan struct{})
+	go n.scheduling()
+	go n.throughputScheduling()
+	go n.historySaving()
+	go n.notificationSending()
 }
 
 func (n *NetworkAvailability) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	var avail = n.checkAvailability()
-	io.WriteString(rw, fmt.Sprintf("refreshIntervalInSeconds: %d\n", n.refreshIntervalInSeconds))
-	io.WriteString(rw, fmt.Sprintf("proxyUrl: %q\n", n.proxyUrlStr))
-	for name := range avail {
-		io.WriteString(rw, fmt.Sprintf("%s(%q) is at %t\n", name, n.targets[name].Url, avail[name] == 1))
+	switch {
+	case req.URL.Path == "/refresh" && req.Method == http.MethodPost:
+		n.HandleRefresh(rw, req)
+	case req.URL.Path == "" || req.URL.Path == "/":
+		if req.URL.Query().Get("refresh") == "1" {
+			n.HandleRefresh(rw, req)
+			return
+		}
+		n.HandleStatusPage(rw, req)
+	case req.URL.Path == "/history":
+		n.HandleHistory(rw, req)
+	case req.URL.Path == "/history.csv":
+		n.HandleHistoryCsv(rw, req)
+	case req.URL.Path == "/probe":
+		n.HandleProbe(rw, req)
+	case req.URL.Path == "/targets" || strings.HasPrefix(req.URL.Path, "/targets/"):
+		n.HandleTargets(rw, req)
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+		io.WriteString(rw, fmt.Sprintf("not found: %s %s\n", req.Method, req.URL.Path))
 	}
 }
 
-func (n *NetworkAvailability) ticking() {
-	var labels = map[string]string{networkAvailabilityTargetLabel: ""}
-	n.lastTick = time.Now()
-	for ; true; n.lastTick = <-n.ticker.C {
-		n.logger.Printf("tick on %s started", n.lastTick)
-		var avail = n.checkAvailability()
-		for name := range avail {
-			labels[networkAvailabilityTargetLabel] = name
-			n.gaugeVec.With(labels).Set(avail[name])
-		}
-		n.logger.Printf("tick on %s completed", n.lastTick)
+// HandleRefresh forces a new round of checks, waits for it and then serves the status page
+func (n *NetworkAvailability) HandleRefresh(rw http.ResponseWriter, req *http.Request) {
+	if n.refreshChan == nil {
+		writeError(rw, http.StatusServiceUnavailable, fmt.Errorf("checks are not running, see the log"))
+		return
+	}
+	n.lock.Lock()
+	var sinceLastRefresh = time.Since(n.lastRefresh)
+	var allowed = sinceLastRefresh >= n.refreshMinInterval
+	if allowed {
+		n.lastRefresh = time.Now()
 	}
+	n.lock.Unlock()
+	if !allowed {
+		var retryAfter = n.refreshMinInterval - sinceLastRefresh
+		n.logger.Printf("refresh from %q rejected, retry after %s", req.RemoteAddr, retryAfter)
+		rw.Header().Set("Retry-After", fmt.Sprintf("%d", int(retryAfter.Seconds())+1))
+		rw.WriteHeader(http.StatusTooManyRequests)
+		io.WriteString(rw, fmt.Sprintf("refresh rate limited, retry after %s\n", retryAfter))
+		return
+	}
+
+	n.logger.Printf("refresh requested from %q", req.RemoteAddr)
+	var done = make(chan struct{})
+	select {
+	case n.refreshChan <- done:
+	case <-req.Context().Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-req.Context().Done():
+		return
+	}
+	n.HandleStatusPage(rw, req)
 }
 
-func (n *NetworkAvailability) checkAvailability() map[string]float64 {
-	var ret = map[string]float64{}
+func (n *NetworkAvailability) HandleStatusPage(rw http.ResponseWriter, req *http.Request) {
+	// written after unlocking, so a slow client does not stall the checks
+	var buf = &bytes.Buffer{}
+	n.lock.Lock()
+	io.WriteString(buf, fmt.Sprintf("refreshIntervalInSeconds: %d\n", n.refreshIntervalInSeconds))
+	io.WriteString(buf, fmt.Sprintf("retryIntervalInSeconds: %d\n", n.retryIntervalInSeconds))
+	io.WriteString(buf, fmt.Sprintf("jitterPercent: %d\n", n.jitterPercent))
+	io.WriteString(buf, fmt.Sprintf("checkTimeout: %s\n", n.checkTimeout))
+	io.WriteString(buf, fmt.Sprintf("proxyUrl: %q\n", redactUrl(n.proxyUrlStr)))
+	io.WriteString(buf, fmt.Sprintf("lastTick: %s\n", n.lastTick))
 	for name, target := range n.targets {
-		n.logger.Printf("checking %s at %s with proxy %t", name, target.Url, target.NeedProxy)
-		var httpClient = http.DefaultClient
-		if target.NeedProxy && n.httpClientWithProxy != nil {
-			httpClient = n.httpClientWithProxy
+		var status = n.statuses[name]
+		io.WriteString(buf, fmt.Sprintf("%s(%s) is at %t, paused %t, checked on %s, next check on %s, latency %s, consecutive failures %d, consecutive successes %d, error %q\n",
+			name, target.describeRequest(), status.Up, target.Paused, status.CheckedAt, n.nextChecks[name], status.Latency, status.ConsecutiveFailures, status.ConsecutiveSuccesses, status.Error))
+		if result, exists := n.throughputs[name]; exists {
+			io.WriteString(buf, fmt.Sprintf("    throughput on %s: %.2f Mbps down (%d bytes), %.2f Mbps up (%d bytes), next test on %s, error %q\n",
+				result.Time, result.DownloadMbps, result.DownloadBytes, result.UploadMbps, result.UploadBytes, n.nextThroughputChecks[name], result.Error))
 		}
-		resp, err := httpClient.Get(target.Url)
-		if err != nil {
-			n.logger.Printf("got error while checking %s: %s", name, err)
-			ret[name] = 0
+		if status.Certificate != nil {
+			io.WriteString(buf, fmt.Sprintf("    certificate %q issued by %q expires on %s, chain valid %t, chain error %q\n",
+				status.Certificate.Subject, status.Certificate.Issuer, status.Certificate.NotAfter, status.Certificate.ChainValid, status.Certificate.ChainError))
+		}
+	}
+
+	for name, diagnosis := range n.diagnoses {
+		io.WriteString(buf, fmt.Sprintf("%s diagnosed as %s on %s: %s\n", name, diagnosis.Classification, diagnosis.Time, diagnosis.Description))
+		for _, p := range diagnosis.Paths {
+			io.WriteString(buf, fmt.Sprintf("    %s: dnsOk %t, ok %t, error %q\n", p.Path, p.DnsOk, p.Ok, p.Error))
+		}
+	}
+	n.lock.Unlock()
+	rw.Write(buf.Bytes())
+}
+
+// scheduling checks every target on its own interval, failing targets on the
+// retry interval, with a random jitter so checks do not fire at the same instant
+func (n *NetworkAvailability) scheduling() {
+	var done chan struct{}
+	for {
+		var now = time.Now()
+		var due = map[string]Target{}
+		n.lock.Lock()
+		for name, target := range n.targets {
+			if target.Paused {
+				delete(n.nextChecks, name)
+				continue
+			}
+			var next, scheduled = n.nextChecks[name]
+			if !scheduled {
+				// spread the first checks over the jitter window
+				next = now.Add(n.jitter(n.targetInterval(target)))
+				n.nextChecks[name] = next
+			}
+			if done != nil || !next.After(now) {
+				due[name] = target
+			}
+		}
+		n.lock.Unlock()
+
+		if len(due) > 0 {
+			n.logger.Printf("round on %s started with %d targets", now, len(due))
+			var statuses = map[string]TargetStatus{}
+			for name, target := range due {
+				statuses[name] = n.checkTarget(name, target)
+			}
+			n.processStatuses(now, statuses)
+			n.runDiagnoses(due)
+			n.logger.Printf("round on %s completed", now)
+		}
+		n.sendNotifications(time.Now())
+		if done != nil {
+			close(done)
+			done = nil
+		}
+
+		var timer = time.NewTimer(time.Until(n.nextWakeUp()))
+		select {
+		case <-timer.C:
+		case <-n.wakeChan:
+		case done = <-n.refreshChan:
+		}
+		timer.Stop()
+	}
+}
+
+func (n *NetworkAvailability) processStatuses(round time.Time, statuses map[string]TargetStatus) {
+	var labels = map[string]string{networkAvailabilityTargetLabel: ""}
+	var events = []availabilityEvent{}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.lastTick = round
+	for name, status := range statuses {
+		var target, exists = n.targets[name]
+		if !exists {
+			// deleted while being checked
+			continue
+		}
+		if status.Up {
+			status.ConsecutiveSuccesses = n.statuses[name].ConsecutiveSuccesses + 1
 		} else {
-			n.logger.Printf("got %d from %s", resp.StatusCode, name)
-			ret[name] = 1
+			status.ConsecutiveFailures = n.statuses[name].ConsecutiveFailures + 1
 		}
-		if resp != nil {
-			resp.Body.Close()
+		if status.Certificate == nil && !status.Up {
+			// failed before a handshake, like on a dns error or a timeout, so
+			// the last certificate is still the best known one
+			status.Certificate = n.statuses[name].Certificate
 		}
+		n.exportCertificate(name, n.statuses[name].Certificate, status.Certificate)
+		n.statuses[name] = status
+		labels[networkAvailabilityTargetLabel] = name
+		n.gaugeVec.With(labels).Set(status.gaugeValue())
+		events = append(events, n.notifier.evaluate(name, target, status)...)
+
+		var interval = n.targetInterval(target)
+		if !status.Up {
+			interval = n.targetRetryInterval(target)
+		}
+		n.nextChecks[name] = time.Now().Add(interval + n.jitter(interval))
+	}
+	n.recordHistory(statuses)
+	n.notifier.queue(events, time.Now())
+}
+
+func (n *NetworkAvailability) sendNotifications(now time.Time) {
+	n.lock.Lock()
+	var events = n.notifier.flush(now)
+	n.lock.Unlock()
+	if len(events) == 0 {
+		return
+	}
+	for _, event := range events {
+		n.logger.Printf("notifying: %s", event)
+	}
+	select {
+	case n.notifier.outbox <- events:
+	default:
+		n.logger.Printf("dropped %d notifications, the previous ones are still being sent", len(events))
+	}
+}
+
+// notificationSending pushes the notifications queued by sendNotifications
+func (n *NetworkAvailability) notificationSending() {
+	for events := range n.notifier.outbox {
+		if err := n.notifier.send(events); err != nil {
+			n.logger.Printf("failed to send notification: %s", err)
+		}
+	}
+}
+
+// nextWakeUp is the earliest scheduled check or pending notification
+func (n *NetworkAvailability) nextWakeUp() time.Time {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	var ret = time.Now().Add(time.Duration(n.refreshIntervalInSeconds) * time.Second)
+	for _, next := range n.nextChecks {
+		if next.Before(ret) {
+			ret = next
+		}
+	}
+	if flush, pending := n.notifier.nextFlush(); pending && flush.Before(ret) {
+		ret = flush
 	}
 	return ret
 }
+
+// wakeUp reschedules after targets changed, without blocking the caller
+func (n *NetworkAvailability) wakeUp() {
+	select {
+	case n.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+func (n *NetworkAvailability) targetInterval(target Target) time.Duration {
+	if target.IntervalInSeconds > 0 {
+		return time.Duration(target.IntervalInSeconds) * time.Second
+	}
+	return time.Duration(n.refreshIntervalInSeconds) * time.Second
+}
+
+func (n *NetworkAvailability) targetTimeout(target Target) time.Duration {
+	if target.TimeoutInSeconds > 0 {
+		return time.Duration(target.TimeoutInSeconds) * time.Second
+	}
+	return n.checkTimeout
+}
+
+func (n *NetworkAvailability) targetRetryInterval(target Target) time.Duration {
+	var ret = time.Duration(n.retryIntervalInSeconds) * time.Second
+	if target.RetryIntervalInSeconds > 0 {
+		ret = time.Duration(target.RetryIntervalInSeconds) * time.Second
+	}
+	if interval := n.targetInterval(target); interval < ret {
+		return interval
+	}
+	return ret
+}
+
+// jitter returns a random duration up to JitterPercent of the interval, it
+// expects the lock to be held as the random source is shared
+func (n *NetworkAvailability) jitter(interval time.Duration) time.Duration {
+	var window = int64(interval) * int64(n.jitterPercent) / 100
+	if window <= 0 {
+		return 0
+	}
+	return time.Duration(n.random.Int63n(window))
+}
+
+func (n *NetworkAvailability) checkTarget(name string, target Target) TargetStatus {
+	n.logger.Printf("checking %s at %s with proxy %t", name, redactUrl(target.Url), target.NeedProxy)
+	var status = TargetStatus{CheckedAt: time.Now()}
+	var handshakes = &handshakeRecorder{}
+	var httpClient, err = n.recordingClientFor(target, handshakes.record)
+	if err != nil {
+		n.logger.Printf("failed to create client for %s: %s", name, err)
+		status.Error = err.Error()
+		return status
+	}
+	req, err := newTargetRequest(target)
+	if err != nil {
+		n.logger.Printf("failed to create request for %s: %s", name, err)
+		status.Error = err.Error()
+		return status
+	}
+	resp, err := httpClient.Do(req)
+	status.Latency = time.Since(status.CheckedAt)
+	if urlErr, ok := err.(*url.Error); ok {
+		// shown on the status page, the query may hold a token
+		urlErr.URL = redactUrl(urlErr.URL)
+	}
+	if err != nil {
+		n.logger.Printf("got error while checking %s: %s", name, err)
+		status.Error = err.Error()
+	} else {
+		n.logger.Printf("got %d from %s", resp.StatusCode, name)
+		status.Up = target.validStatusCode(resp.StatusCode)
+		status.StatusCode = resp.StatusCode
+		if !status.Up {
+			status.Error = fmt.Sprintf("invalid status code %d", resp.StatusCode)
+		}
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	// also seen when the handshake failed on the certificate
+	status.Certificate = inspectCertificate(target, handshakes.last())
+	return status
+}
+
+func (n *NetworkAvailability) runDiagnoses(targets map[string]Target) {
+	for name, target := range targets {
+		if !target.Diagnose && !n.diagnoseAllTargets {
+			continue
+		}
+		n.logger.Printf("diagnosing %s at %s", name, redactUrl(target.Url))
+		var diagnosis = n.diagnose(target)
+		n.logger.Printf("%s diagnosed as %s", name, diagnosis.Classification)
+		n.lock.Lock()
+		// deleted or no longer diagnosed while being diagnosed
+		if current, exists := n.targets[name]; exists && (current.Diagnose || n.diagnoseAllTargets) {
+			n.exportDiagnosis(name, diagnosis)
+			n.diagnoses[name] = diagnosis
+		}
+		n.lock.Unlock()
+	}
+}
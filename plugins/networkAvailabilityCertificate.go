@@ -0,0 +1,136 @@
+// record the leaf certificate of https targets, so an expiring certificate is
+// noticed before our self-hosted services break
+
+package plugins
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+const networkAvailabilityCertExpiryMetricName = "network_availability_cert_expiry_seconds"
+const networkAvailabilityCertValidMetricName = "network_availability_cert_chain_valid"
+const networkAvailabilityCertInfoMetricName = "network_availability_cert_info"
+const networkAvailabilityIssuerLabel = "issuer"
+
+var networkAvailabilityCertLables = []string{networkAvailabilityTargetLabel}
+var networkAvailabilityCertInfoLables = []string{networkAvailabilityTargetLabel, networkAvailabilityIssuerLabel}
+
+type CertificateStatus struct {
+	Subject    string    `json:"subject"`
+	Issuer     string    `json:"issuer"`
+	NotAfter   time.Time `json:"notAfter"`
+	ChainValid bool      `json:"chainValid"`
+	ChainError string    `json:"chainError,omitempty"`
+}
+
+// handshakeRecorder keeps the last handshake of a check, the hook runs on the
+// dialing goroutine, which may outlive a request that timed out
+type handshakeRecorder struct {
+	lock  sync.Mutex
+	state *tls.ConnectionState
+}
+
+func (r *handshakeRecorder) record(state tls.ConnectionState) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.state = &state
+}
+
+func (r *handshakeRecorder) last() *tls.ConnectionState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.state
+}
+
+// recordHandshakes moves the verification of the chain into a hook, so record
+// also sees the certificates of a handshake that fails on an expired or
+// self-signed certificate
+func recordHandshakes(tlsConfig *tls.Config, record func(tls.ConnectionState)) {
+	var skipVerify = tlsConfig.InsecureSkipVerify
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		record(state)
+		if skipVerify {
+			return nil
+		}
+		return verifyChain(state, tlsConfig.RootCAs)
+	}
+}
+
+// verifyChain verifies the certificates of a handshake against roots, or the
+// system roots when nil
+func verifyChain(state tls.ConnectionState, roots *x509.CertPool) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("no peer certificate")
+	}
+	var opts = x509.VerifyOptions{
+		DNSName:       state.ServerName,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	var _, err = state.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// inspectCertificate verifies the chain itself, as the handshake may have
+// skipped verification for targets with insecureSkipVerify
+func inspectCertificate(target Target, state *tls.ConnectionState) *CertificateStatus {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	var leaf = state.PeerCertificates[0]
+	var ret = &CertificateStatus{
+		Subject:  leaf.Subject.String(),
+		Issuer:   leaf.Issuer.String(),
+		NotAfter: leaf.NotAfter,
+	}
+	var roots *x509.CertPool
+	if target.CaFile != "" {
+		if pem, err := ioutil.ReadFile(target.CaFile); err == nil {
+			roots = x509.NewCertPool()
+			roots.AppendCertsFromPEM(pem)
+		}
+	}
+	if err := verifyChain(*state, roots); err != nil {
+		ret.ChainError = err.Error()
+	} else {
+		ret.ChainValid = true
+	}
+	return ret
+}
+
+// exportCertificate expects the lock to be held, the series of a target are
+// deleted when it has no certificate any more, like after its url changed to
+// http, rather than keeping stale values
+func (n *NetworkAvailability) exportCertificate(name string, previous *CertificateStatus, cert *CertificateStatus) {
+	if cert == nil {
+		n.deleteCertificateSeries(name, previous)
+		return
+	}
+	if previous != nil && previous.Issuer != cert.Issuer {
+		n.certInfoGaugeVec.DeleteLabelValues(name, previous.Issuer)
+	}
+	n.certExpiryGaugeVec.WithLabelValues(name).Set(time.Until(cert.NotAfter).Seconds())
+	var valid float64 = 0
+	if cert.ChainValid {
+		valid = 1
+	}
+	n.certValidGaugeVec.WithLabelValues(name).Set(valid)
+	n.certInfoGaugeVec.WithLabelValues(name, cert.Issuer).Set(1)
+}
+
+func (n *NetworkAvailability) deleteCertificateSeries(name string, cert *CertificateStatus) {
+	n.certExpiryGaugeVec.DeleteLabelValues(name)
+	n.certValidGaugeVec.DeleteLabelValues(name)
+	if cert != nil {
+		n.certInfoGaugeVec.DeleteLabelValues(name, cert.Issuer)
+	}
+}
@@ -0,0 +1,89 @@
+package plugins
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExportCertificateDeletesAllSeries(t *testing.T) {
+	var n = &NetworkAvailability{
+		certExpiryGaugeVec: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_cert_expiry"}, networkAvailabilityCertLables),
+		certValidGaugeVec:  prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_cert_valid"}, networkAvailabilityCertLables),
+		certInfoGaugeVec:   prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_cert_info"}, networkAvailabilityCertInfoLables),
+	}
+	var count = func() int {
+		return testutil.CollectAndCount(n.certExpiryGaugeVec) + testutil.CollectAndCount(n.certValidGaugeVec) + testutil.CollectAndCount(n.certInfoGaugeVec)
+	}
+	var first = &CertificateStatus{Issuer: "CN=First", NotAfter: time.Now().Add(time.Hour), ChainValid: true}
+	var second = &CertificateStatus{Issuer: "CN=Second", NotAfter: time.Now().Add(time.Hour)}
+	n.exportCertificate("nas", nil, first)
+	if got := count(); got != 3 {
+		t.Errorf("got %d series, want 3", got)
+	}
+	// a new issuer replaces the info series
+	n.exportCertificate("nas", first, second)
+	if got := count(); got != 3 || testutil.ToFloat64(n.certInfoGaugeVec.WithLabelValues("nas", "CN=Second")) != 1 {
+		t.Errorf("got %d series, want 3 with the second issuer", got)
+	}
+	n.exportCertificate("nas", second, nil)
+	if got := count(); got != 0 {
+		t.Errorf("got %d series without a certificate, want none", got)
+	}
+}
+
+func TestCheckTargetRecordsInvalidCertificate(t *testing.T) {
+	var server = httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	var n = &NetworkAvailability{logger: log.New(ioutil.Discard, "", 0), checkTimeout: 5 * time.Second}
+
+	// the handshake fails, as the test certificate is not trusted
+	var status = n.checkTarget("nas", Target{Url: server.URL})
+	if status.Up || status.Certificate == nil || status.Certificate.ChainValid || status.Certificate.ChainError == "" {
+		t.Errorf("got up %t with certificate %+v, want down with an invalid chain", status.Up, status.Certificate)
+	}
+
+	var caFile = filepath.Join(t.TempDir(), "ca.pem")
+	var caPem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPem, 0644); err != nil {
+		t.Fatal(err)
+	}
+	status = n.checkTarget("nas", Target{Url: server.URL, CaFile: caFile})
+	if !status.Up || status.Certificate == nil || !status.Certificate.ChainValid {
+		t.Errorf("got up %t with certificate %+v and error %q, want up with a valid chain", status.Up, status.Certificate, status.Error)
+	}
+	if !status.Certificate.NotAfter.Equal(server.Certificate().NotAfter) {
+		t.Errorf("got expiry %s, want %s", status.Certificate.NotAfter, server.Certificate().NotAfter)
+	}
+
+	status = n.checkTarget("nas", Target{Url: server.URL, InsecureSkipVerify: true})
+	if !status.Up || status.Certificate == nil || status.Certificate.ChainValid {
+		t.Errorf("got up %t with certificate %+v, want up with an invalid chain", status.Up, status.Certificate)
+	}
+}
+
+func TestCertificateKeptWhenCheckFailsBeforeHandshake(t *testing.T) {
+	var n = newTestAvailability(t)
+	n.targets["nas"] = Target{Url: "https://nas.lan"}
+	var count = func() int {
+		return testutil.CollectAndCount(n.certExpiryGaugeVec) + testutil.CollectAndCount(n.certValidGaugeVec) + testutil.CollectAndCount(n.certInfoGaugeVec)
+	}
+	var cert = &CertificateStatus{Issuer: "CN=First", NotAfter: time.Now().Add(time.Hour), ChainValid: true}
+	n.processStatuses(time.Now(), map[string]TargetStatus{"nas": {Up: true, Certificate: cert}})
+	n.processStatuses(time.Now(), map[string]TargetStatus{"nas": {Error: "i/o timeout"}})
+	if got := count(); got != 3 || n.statuses["nas"].Certificate != cert {
+		t.Errorf("got %d series and certificate %+v after a timeout, want 3 and the last one", got, n.statuses["nas"].Certificate)
+	}
+	n.processStatuses(time.Now(), map[string]TargetStatus{"nas": {Up: true}})
+	if got := count(); got != 0 {
+		t.Errorf("got %d series after a check without a certificate, want none", got)
+	}
+}
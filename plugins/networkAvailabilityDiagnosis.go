@@ -0,0 +1,233 @@
+// probe the same target through every configured path (direct with the system
+// resolver, direct with each alternative resolver, and each proxy) and classify
+// where the problem is: our uplink, dns, the proxy or the site itself
+
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const networkAvailabilityPathMetricName = "network_availability_path"
+const networkAvailabilityDiagnosisMetricName = "network_availability_diagnosis"
+const networkAvailabilityPathLabel = "path"
+const networkAvailabilityDiagnosisLabel = "diagnosis"
+
+var networkAvailabilityPathLables = []string{networkAvailabilityTargetLabel, networkAvailabilityPathLabel}
+var networkAvailabilityDiagnosisLables = []string{networkAvailabilityTargetLabel, networkAvailabilityDiagnosisLabel}
+
+const (
+	diagnosisOk            = "ok"
+	diagnosisProxyFailure  = "proxy_failure"
+	diagnosisDnsFailure    = "dns_failure"
+	diagnosisBlockedDirect = "blocked_direct"
+	diagnosisSiteDown      = "site_down"
+	diagnosisUplinkDown    = "uplink_down"
+	diagnosisUnknown       = "unknown"
+)
+
+var diagnosisDescriptions = map[string]string{
+	diagnosisOk:            "works directly and via every proxy",
+	diagnosisProxyFailure:  "works directly, fails via proxy",
+	diagnosisDnsFailure:    "fails with the system resolver, works with an alternative resolver",
+	diagnosisBlockedDirect: "blocked directly, works via proxy",
+	diagnosisSiteDown:      "fails on every path while dns and proxies are reachable, site is down",
+	diagnosisUplinkDown:    "fails on every path including dns and proxies, uplink is down",
+	diagnosisUnknown:       "could not classify",
+}
+
+type diagnosisPath struct {
+	name     string
+	resolver *net.Resolver
+	dialer   *net.Dialer
+	proxyUrl *url.URL
+	viaProxy bool
+	timeout  time.Duration
+}
+
+// clientFor builds the client of a path with the tls and redirect settings of
+// the target, so a path fails only for the reason it is there to find
+func (p diagnosisPath) clientFor(target Target) (*http.Client, error) {
+	var tlsConfig, err = targetTLSConfig(target)
+	if err != nil {
+		return nil, err
+	}
+	var transport = &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true}
+	if p.dialer != nil {
+		transport.DialContext = p.dialer.DialContext
+	}
+	if p.proxyUrl != nil {
+		transport.Proxy = http.ProxyURL(p.proxyUrl)
+	}
+	var client = &http.Client{Timeout: p.timeout, Transport: transport}
+	setRedirectPolicy(client, target)
+	return client, nil
+}
+
+type PathResult struct {
+	Path     string `json:"path"`
+	ViaProxy bool   `json:"viaProxy"`
+	DnsOk    bool   `json:"dnsOk"`
+	Ok       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+}
+
+type Diagnosis struct {
+	Time           time.Time    `json:"time"`
+	Classification string       `json:"classification"`
+	Description    string       `json:"description"`
+	Paths          []PathResult `json:"paths"`
+}
+
+// buildDiagnosisPaths creates one path for the system resolver, one for each
+// alternative resolver like "1.1.1.1:53" and one for each proxy url
+func buildDiagnosisPaths(resolvers []string, proxyUrls []*url.URL, timeout time.Duration) []diagnosisPath {
+	var ret = []diagnosisPath{{
+		name:     "direct",
+		resolver: net.DefaultResolver,
+		timeout:  timeout,
+	}}
+	for _, resolverAddr := range resolvers {
+		var resolver = newResolver(resolverAddr, timeout)
+		ret = append(ret, diagnosisPath{
+			name:     fmt.Sprintf("direct@%s", resolverAddr),
+			resolver: resolver,
+			dialer:   &net.Dialer{Timeout: timeout, Resolver: resolver},
+			timeout:  timeout,
+		})
+	}
+	for _, proxyUrl := range proxyUrls {
+		ret = append(ret, diagnosisPath{
+			name:     fmt.Sprintf("proxy@%s", proxyUrl.Host),
+			proxyUrl: proxyUrl,
+			viaProxy: true,
+			timeout:  timeout,
+		})
+	}
+	return ret
+}
+
+func newResolver(addr string, timeout time.Duration) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d = net.Dialer{Timeout: timeout}
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func (n *NetworkAvailability) diagnose(target Target) Diagnosis {
+	var ret = Diagnosis{Time: time.Now()}
+	var host = ""
+	if u, err := url.Parse(target.Url); err == nil {
+		host = u.Hostname()
+	}
+	for _, path := range n.diagnosisPaths {
+		var result = PathResult{Path: path.name, ViaProxy: path.viaProxy}
+		if !path.viaProxy {
+			var ctx, cancel = context.WithTimeout(context.Background(), n.diagnosisTimeout)
+			_, err := path.resolver.LookupHost(ctx, host)
+			cancel()
+			if err != nil {
+				result.Error = err.Error()
+				ret.Paths = append(ret.Paths, result)
+				continue
+			}
+			result.DnsOk = true
+		}
+		result.Ok, result.Error = diagnosePath(path, target)
+		ret.Paths = append(ret.Paths, result)
+	}
+	ret.Classification = classifyDiagnosis(ret.Paths)
+	ret.Description = diagnosisDescriptions[ret.Classification]
+	return ret
+}
+
+// diagnosePath sends the request of the target like the check does
+func diagnosePath(path diagnosisPath, target Target) (bool, string) {
+	var client, err = path.clientFor(target)
+	if err != nil {
+		return false, err.Error()
+	}
+	req, err := newTargetRequest(target)
+	if err != nil {
+		return false, err.Error()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err.Error()
+	}
+	resp.Body.Close()
+	if !target.validStatusCode(resp.StatusCode) {
+		return false, fmt.Sprintf("invalid status code %d", resp.StatusCode)
+	}
+	return true, ""
+}
+
+// classifyDiagnosis expects the system resolver path to be the first one
+func classifyDiagnosis(paths []PathResult) string {
+	if len(paths) == 0 {
+		return diagnosisUnknown
+	}
+	var system = paths[0]
+	var anyDirectOk, anyDnsOk, anyProxyOk, anyProxyFailed, anyProxyReachable = false, false, false, false, false
+	for _, p := range paths {
+		if p.ViaProxy {
+			if p.Ok {
+				anyProxyOk = true
+			} else {
+				anyProxyFailed = true
+				// the proxy answered but could not reach the target
+				if !strings.Contains(p.Error, "proxyconnect") {
+					anyProxyReachable = true
+				}
+			}
+			continue
+		}
+		if p.Ok {
+			anyDirectOk = true
+		}
+		if p.DnsOk {
+			anyDnsOk = true
+		}
+	}
+	switch {
+	case system.Ok && anyProxyFailed:
+		return diagnosisProxyFailure
+	case system.Ok:
+		return diagnosisOk
+	case anyDirectOk:
+		// the only difference between direct paths is the resolver
+		return diagnosisDnsFailure
+	case anyProxyOk:
+		return diagnosisBlockedDirect
+	case anyDnsOk || anyProxyReachable:
+		return diagnosisSiteDown
+	default:
+		return diagnosisUplinkDown
+	}
+}
+
+func (n *NetworkAvailability) exportDiagnosis(name string, diagnosis Diagnosis) {
+	for _, p := range diagnosis.Paths {
+		var value float64 = 0
+		if p.Ok {
+			value = 1
+		}
+		n.pathGaugeVec.With(map[string]string{networkAvailabilityTargetLabel: name, networkAvailabilityPathLabel: p.Path}).Set(value)
+	}
+	for classification := range diagnosisDescriptions {
+		var value float64 = 0
+		if classification == diagnosis.Classification {
+			value = 1
+		}
+		n.diagnosisGaugeVec.With(map[string]string{networkAvailabilityTargetLabel: name, networkAvailabilityDiagnosisLabel: classification}).Set(value)
+	}
+}
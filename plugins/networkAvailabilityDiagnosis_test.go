@@ -0,0 +1,39 @@
+package plugins
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiagnoseUsesTargetRequest(t *testing.T) {
+	var server = httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("X-Api-Key") != "secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	var caFile = filepath.Join(t.TempDir(), "ca.pem")
+	var caPem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPem, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var n = &NetworkAvailability{diagnosisTimeout: 5 * time.Second}
+	n.diagnosisPaths = buildDiagnosisPaths(nil, nil, n.diagnosisTimeout)
+
+	var target = Target{Url: server.URL, Method: http.MethodPost, Headers: map[string]string{"X-Api-Key": "secret"}, CaFile: caFile, ValidStatusCodes: []int{200}}
+	var diagnosis = n.diagnose(target)
+	if diagnosis.Classification != diagnosisOk {
+		t.Errorf("got %s with paths %+v, want %s", diagnosis.Classification, diagnosis.Paths, diagnosisOk)
+	}
+
+	target.Headers = nil
+	diagnosis = n.diagnose(target)
+	if diagnosis.Classification != diagnosisSiteDown || diagnosis.Paths[0].Error != "invalid status code 401" {
+		t.Errorf("got %s with paths %+v, want %s", diagnosis.Classification, diagnosis.Paths, diagnosisSiteDown)
+	}
+}
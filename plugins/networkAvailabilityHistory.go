@@ -0,0 +1,306 @@
+// keep a bounded history of check results per target, persisted to a json file,
+// and report uptime ratios and outage intervals from it, a sample is a run of
+// checks with the same result, so MaxHistorySamples bounds the state changes
+
+package plugins
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"garfield/rpi-api-server/utils"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const networkAvailabilityUptimeMetricName = "network_availability_uptime_ratio"
+const networkAvailabilityWindowLabel = "window"
+
+var networkAvailabilityUptimeLables = []string{networkAvailabilityTargetLabel, networkAvailabilityWindowLabel}
+
+// the longest window also decides how long samples are kept
+var uptimeWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+// HistorySample is a run of checks with the same result, from the first check
+// until the check expected after the last one, so the time a target was not
+// checked, like while paused or restarting, is not counted
+type HistorySample struct {
+	Time  time.Time `json:"t"`
+	Up    bool      `json:"up"`
+	Last  time.Time `json:"l"`
+	Until time.Time `json:"u"`
+}
+
+type Outage struct {
+	Start             time.Time `json:"start"`
+	End               time.Time `json:"end"`
+	DurationInSeconds float64   `json:"durationInSeconds"`
+	Ongoing           bool      `json:"ongoing"`
+}
+
+type TargetHistoryReport struct {
+	Uptime  map[string]float64 `json:"uptime"`
+	Samples int                `json:"samples"`
+	Outages []Outage           `json:"outages"`
+}
+
+type availabilityHistory struct {
+	filePath   string
+	maxSamples int
+	samples    map[string][]HistorySample
+	// changed since the last save
+	dirty bool
+}
+
+func loadAvailabilityHistory(filePath string, maxSamples int) (*availabilityHistory, error) {
+	var ret = &availabilityHistory{
+		filePath:   filePath,
+		maxSamples: maxSamples,
+		samples:    map[string][]HistorySample{},
+	}
+	jsonBytes, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return ret, err
+	}
+	if err = json.Unmarshal(jsonBytes, &ret.samples); err != nil {
+		return ret, err
+	}
+	// a sample of older files is one check, which lasted until the next one
+	for _, samples := range ret.samples {
+		for i := range samples {
+			if !samples[i].Until.IsZero() {
+				continue
+			}
+			samples[i].Last, samples[i].Until = samples[i].Time, samples[i].Time
+			if i+1 < len(samples) {
+				samples[i].Until = samples[i+1].Time
+			}
+		}
+	}
+	return ret, nil
+}
+
+// add extends the last run when the result did not change and the check was
+// at most an interval late, otherwise it starts a new run, next is the time of
+// the next expected check
+func (h *availabilityHistory) add(name string, checkedAt time.Time, up bool, next time.Time) {
+	var samples = h.samples[name]
+	var last = len(samples) - 1
+	if last >= 0 && samples[last].Up == up && !checkedAt.After(samples[last].Until.Add(samples[last].Until.Sub(samples[last].Last))) {
+		samples[last].Last, samples[last].Until = checkedAt, next
+	} else {
+		samples = append(samples, HistorySample{Time: checkedAt, Up: up, Last: checkedAt, Until: next})
+	}
+	var oldest = checkedAt.Add(-uptimeWindows[len(uptimeWindows)-1].duration)
+	var first = 0
+	for first < len(samples) && samples[first].Until.Before(oldest) {
+		first++
+	}
+	if len(samples)-first > h.maxSamples {
+		first = len(samples) - h.maxSamples
+	}
+	h.samples[name] = samples[first:]
+	h.dirty = true
+}
+
+// snapshot returns a copy of the samples to save when they changed, so they
+// can be marshalled while add goes on
+func (h *availabilityHistory) snapshot() (map[string][]HistorySample, bool) {
+	if !h.dirty {
+		return nil, false
+	}
+	h.dirty = false
+	var ret = map[string][]HistorySample{}
+	for name, samples := range h.samples {
+		ret[name] = append([]HistorySample{}, samples...)
+	}
+	return ret, true
+}
+
+func (h *availabilityHistory) save(samples map[string][]HistorySample) error {
+	jsonBytes, err := json.Marshal(samples)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomically(h.filePath, jsonBytes)
+}
+
+// uptime returns the share of the checked time of the window the target was
+// up, or -1 without samples
+func (h *availabilityHistory) uptime(name string, now time.Time, window time.Duration) float64 {
+	var start = now.Add(-window)
+	var samples = h.samples[name]
+	var total, up time.Duration
+	for i, sample := range samples {
+		var from, until = sample.Time, sample.Until
+		if i+1 < len(samples) && samples[i+1].Time.Before(until) {
+			until = samples[i+1].Time
+		}
+		if now.Before(until) {
+			until = now
+		}
+		if from.Before(start) {
+			from = start
+		}
+		if !until.After(from) {
+			continue
+		}
+		total += until.Sub(from)
+		if sample.Up {
+			up += until.Sub(from)
+		}
+	}
+	if total == 0 {
+		return -1
+	}
+	return float64(up) / float64(total)
+}
+
+// outages starts at the first failed sample and ends at the next successful one
+func (h *availabilityHistory) outages(name string, now time.Time) []Outage {
+	var ret = []Outage{}
+	var current *Outage
+	for _, sample := range h.samples[name] {
+		if !sample.Up && current == nil {
+			current = &Outage{Start: sample.Time}
+		} else if sample.Up && current != nil {
+			current.End = sample.Time
+			current.DurationInSeconds = current.End.Sub(current.Start).Seconds()
+			ret = append(ret, *current)
+			current = nil
+		}
+	}
+	if current != nil {
+		current.End = now
+		current.DurationInSeconds = now.Sub(current.Start).Seconds()
+		current.Ongoing = true
+		ret = append(ret, *current)
+	}
+	return ret
+}
+
+func (h *availabilityHistory) report(now time.Time) map[string]TargetHistoryReport {
+	var ret = map[string]TargetHistoryReport{}
+	for name := range h.samples {
+		var report = TargetHistoryReport{
+			Uptime:  map[string]float64{},
+			Samples: len(h.samples[name]),
+			Outages: h.outages(name, now),
+		}
+		for _, window := range uptimeWindows {
+			report.Uptime[window.name] = h.uptime(name, now, window.duration)
+		}
+		ret[name] = report
+	}
+	return ret
+}
+
+func (h *availabilityHistory) delete(name string) {
+	delete(h.samples, name)
+	h.dirty = true
+}
+
+// recordHistory expects the lock to be held and the next checks to be scheduled
+func (n *NetworkAvailability) recordHistory(statuses map[string]TargetStatus) {
+	var now = time.Now()
+	for name, status := range statuses {
+		if _, exists := n.targets[name]; !exists {
+			continue
+		}
+		n.history.add(name, status.CheckedAt, status.Up, n.nextChecks[name])
+		for _, window := range uptimeWindows {
+			var ratio = n.history.uptime(name, now, window.duration)
+			if ratio < 0 {
+				continue
+			}
+			n.uptimeGaugeVec.With(map[string]string{networkAvailabilityTargetLabel: name, networkAvailabilityWindowLabel: window.name}).Set(ratio)
+		}
+	}
+}
+
+// historySaving writes the history on a timer rather than after every check,
+// as the file is rewritten as a whole and the sd card of a pi wears out
+func (n *NetworkAvailability) historySaving() {
+	var ticker = time.NewTicker(n.historySaveInterval)
+	for range ticker.C {
+		n.lock.Lock()
+		var samples, changed = n.history.snapshot()
+		n.lock.Unlock()
+		if !changed {
+			continue
+		}
+		if err := n.history.save(samples); err != nil {
+			n.logger.Printf("failed to save history to %q: %s", n.history.filePath, err)
+			n.lock.Lock()
+			n.history.dirty = true
+			n.lock.Unlock()
+		}
+	}
+}
+
+func (n *NetworkAvailability) HandleHistory(rw http.ResponseWriter, req *http.Request) {
+	n.lock.Lock()
+	var report = n.history.report(time.Now())
+	n.lock.Unlock()
+
+	writeJson(rw, http.StatusOK, report)
+}
+
+func (n *NetworkAvailability) HandleHistoryCsv(rw http.ResponseWriter, req *http.Request) {
+	n.lock.Lock()
+	var report = n.history.report(time.Now())
+	n.lock.Unlock()
+
+	var names = []string{}
+	for name := range report {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// one row per outage, or a single row without outages, each with the
+	// uptime percentages of the target, empty without samples
+	rw.Header().Set("Content-Type", "text/csv")
+	rw.WriteHeader(http.StatusOK)
+	var writer = csv.NewWriter(rw)
+	var header = []string{"target"}
+	for _, window := range uptimeWindows {
+		header = append(header, "uptime_percent_"+window.name)
+	}
+	writer.Write(append(header, "outage_start", "outage_end", "outage_duration_seconds", "outage_ongoing"))
+	for _, name := range names {
+		var uptimes = []string{name}
+		for _, window := range uptimeWindows {
+			var percent = ""
+			if ratio := report[name].Uptime[window.name]; ratio >= 0 {
+				percent = fmt.Sprintf("%.3f", ratio*100)
+			}
+			uptimes = append(uptimes, percent)
+		}
+		if len(report[name].Outages) == 0 {
+			writer.Write(append(uptimes, "", "", "", ""))
+		}
+		for _, outage := range report[name].Outages {
+			writer.Write(append(append([]string{}, uptimes...),
+				outage.Start.Format(time.RFC3339),
+				outage.End.Format(time.RFC3339),
+				fmt.Sprintf("%.0f", outage.DurationInSeconds),
+				strconv.FormatBool(outage.Ongoing),
+			))
+		}
+	}
+	writer.Flush()
+}
@@ -0,0 +1,141 @@
+package plugins
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUptimeWeightsSamplesByTime(t *testing.T) {
+	var now = time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	var h = &availabilityHistory{maxSamples: 10000, samples: map[string][]HistorySample{}}
+	// up every 5 minutes for 20 hours, then down for 4 hours checked every minute
+	var at = now.Add(-24 * time.Hour)
+	for ; at.Before(now.Add(-4 * time.Hour)); at = at.Add(5 * time.Minute) {
+		h.add("router", at, true, at.Add(5*time.Minute))
+	}
+	for ; at.Before(now); at = at.Add(time.Minute) {
+		h.add("router", at, false, at.Add(time.Minute))
+	}
+	if got := len(h.samples["router"]); got != 2 {
+		t.Errorf("got %d samples, want a run of up and a run of down checks", got)
+	}
+	if got := h.uptime("router", now, 24*time.Hour); math.Abs(got-20.0/24) > 1e-9 {
+		t.Errorf("got %f for 24h, want %f", got, 20.0/24)
+	}
+	// the window starts within the run of up checks
+	if got := h.uptime("router", now, 6*time.Hour); math.Abs(got-2.0/6) > 1e-9 {
+		t.Errorf("got %f for 6h, want %f", got, 2.0/6)
+	}
+	if got := h.uptime("router", now, time.Hour); got != 0 {
+		t.Errorf("got %f for 1h, want 0", got)
+	}
+	if got := h.uptime("unknown", now, time.Hour); got != -1 {
+		t.Errorf("got %f without samples, want -1", got)
+	}
+}
+
+func TestUptimeSkipsUncheckedTime(t *testing.T) {
+	var now = time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	var h = &availabilityHistory{maxSamples: 10000, samples: map[string][]HistorySample{}}
+	// down for an hour, then not checked for 10 hours like while the pi was off
+	var at = now.Add(-12 * time.Hour)
+	for ; at.Before(now.Add(-11 * time.Hour)); at = at.Add(time.Minute) {
+		h.add("router", at, false, at.Add(time.Minute))
+	}
+	if got := h.uptime("router", now, 24*time.Hour); got != 0 {
+		t.Errorf("got %f, want 0", got)
+	}
+	for at = now.Add(-time.Hour); at.Before(now); at = at.Add(5 * time.Minute) {
+		h.add("router", at, true, at.Add(5*time.Minute))
+	}
+	if got := h.uptime("router", now, 24*time.Hour); math.Abs(got-0.5) > 1e-9 {
+		t.Errorf("got %f, want 0.5 for an hour down and an hour up", got)
+	}
+	if got := len(h.samples["router"]); got != 2 {
+		t.Errorf("got %d samples, want 2", got)
+	}
+}
+
+func TestHistoryLoadsSamplesOfChecks(t *testing.T) {
+	var filePath = filepath.Join(t.TempDir(), "history.json")
+	var old = `{"router": [{"t": "2026-01-01T00:00:00Z", "up": true}, {"t": "2026-01-01T03:00:00Z", "up": false}, {"t": "2026-01-01T04:00:00Z", "up": false}]}`
+	if err := ioutil.WriteFile(filePath, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var h, err = loadAvailabilityHistory(filePath, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var now = time.Date(2026, 1, 1, 4, 0, 0, 0, time.UTC)
+	if got := h.uptime("router", now, 24*time.Hour); math.Abs(got-0.75) > 1e-9 {
+		t.Errorf("got %f, want 0.75", got)
+	}
+	// the interval of the last check is unknown, so the next one starts a run
+	h.add("router", now.Add(time.Minute), false, now.Add(2*time.Minute))
+	h.add("router", now.Add(2*time.Minute), false, now.Add(3*time.Minute))
+	if got := len(h.samples["router"]); got != 4 {
+		t.Errorf("got %d samples, want 4", got)
+	}
+}
+
+func TestHistorySavedOnlyWhenChanged(t *testing.T) {
+	var filePath = filepath.Join(t.TempDir(), "history.json")
+	var h, err = loadAvailabilityHistory(filePath, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var now = time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		var at = now.Add(time.Duration(i) * time.Minute)
+		h.add("router", at, i%2 == 0, at.Add(time.Minute))
+	}
+	var samples, changed = h.snapshot()
+	if !changed {
+		t.Fatal("expected changed samples")
+	}
+	// checks added after the snapshot do not change it
+	h.add("router", now.Add(5*time.Minute), true, now.Add(6*time.Minute))
+	if err = h.save(samples); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadAvailabilityHistory(filePath, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.samples["router"]) != 3 || !loaded.samples["router"][2].Until.Equal(now.Add(5*time.Minute)) {
+		t.Errorf("got %v, want the 3 samples of the snapshot", loaded.samples)
+	}
+	if _, changed = h.snapshot(); !changed {
+		t.Errorf("expected the later check to be saved next")
+	}
+	if _, changed = h.snapshot(); changed {
+		t.Errorf("expected no change since the last snapshot")
+	}
+	if !reflect.DeepEqual(samples["router"], loaded.samples["router"]) {
+		t.Errorf("got %v, want %v", loaded.samples["router"], samples["router"])
+	}
+}
+
+func TestHistoryCsvHasUptime(t *testing.T) {
+	var n = newTestAvailability(t)
+	var now = time.Now()
+	n.history.add("router", now.Add(-2*time.Hour), true, now.Add(-time.Hour))
+	n.history.add("router", now.Add(-time.Hour), false, now)
+	n.history.add("nas", now.Add(-time.Hour), true, now)
+	var rw = httptest.NewRecorder()
+	n.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/history.csv", nil))
+	var lines = strings.Split(strings.TrimSpace(rw.Body.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "target,uptime_percent_24h,uptime_percent_7d,uptime_percent_30d,outage_start") {
+		t.Fatalf("got %q", lines)
+	}
+	if !strings.HasPrefix(lines[1], "nas,100.000,100.000,100.000,,,,") || !strings.HasPrefix(lines[2], "router,50.000,50.000,50.000,") || !strings.HasSuffix(lines[2], ",true") {
+		t.Errorf("got %q", lines[1:])
+	}
+}
@@ -0,0 +1,206 @@
+// notify when a target goes down or recovers, a target is considered down after
+// N consecutive failures and recovered after M consecutive successes, so a
+// flapping target does not flood us with messages
+
+package plugins
+
+import (
+	"fmt"
+	"garfield/rpi-api-server/utils"
+	"strings"
+	"time"
+)
+
+const networkAvailabilityNotificationTitle = "Network"
+
+type alertState struct {
+	down         bool
+	failingSince time.Time
+	notified     bool
+	lastNotified time.Time
+	// expiry of the last certificate we warned about, to warn once per certificate
+	certWarned time.Time
+}
+
+const (
+	eventDown       = "down"
+	eventRecovered  = "recovered"
+	eventCertExpiry = "certificate expiring"
+)
+
+type availabilityEvent struct {
+	name     string
+	kind     string
+	since    time.Time
+	duration time.Duration
+	err      string
+	cert     *CertificateStatus
+}
+
+func (e availabilityEvent) String() string {
+	switch e.kind {
+	case eventDown:
+		return fmt.Sprintf("%s is down since %s: %s", e.name, e.since.Format(time.RFC3339), e.err)
+	case eventCertExpiry:
+		var left = time.Until(e.cert.NotAfter)
+		if left < 0 {
+			return fmt.Sprintf("%s certificate issued by %s expired on %s, %d days ago",
+				e.name, e.cert.Issuer, e.cert.NotAfter.Format(time.RFC3339), int(-left.Hours()/24))
+		}
+		return fmt.Sprintf("%s certificate issued by %s expires on %s, in %d days",
+			e.name, e.cert.Issuer, e.cert.NotAfter.Format(time.RFC3339), int(left.Hours()/24))
+	default:
+		return fmt.Sprintf("%s recovered after %s", e.name, e.duration.Round(time.Second))
+	}
+}
+
+type availabilityNotifier struct {
+	pusher            utils.NotificationPusher
+	priority          int
+	downThreshold     int
+	recoveryThreshold int
+	minInterval       time.Duration
+	digest            bool
+	certWarningPeriod time.Duration
+	// targets are checked at different times, so in digest mode events are
+	// held for a window to group the ones failing at once
+	digestWindow time.Duration
+	pending      []availabilityEvent
+	pendingSince time.Time
+	states       map[string]*alertState
+	// pushes are sent apart from the checks, one that hangs would stall them
+	outbox chan []availabilityEvent
+}
+
+// newAvailabilityNotifier only asks for a pusher when PUSH_SERVICE is set, as
+// utils.GetNotificationPusher panics without it
+func newAvailabilityNotifier() *availabilityNotifier {
+	var ret = &availabilityNotifier{
+		priority:          utils.GetEnvVarInt("NotificationPriority", 0),
+		downThreshold:     utils.GetEnvVarInt("NotificationDownThreshold", 3),
+		recoveryThreshold: utils.GetEnvVarInt("NotificationRecoveryThreshold", 2),
+		minInterval:       time.Duration(utils.GetEnvVarInt("NotificationMinIntervalInSeconds", 600)) * time.Second,
+		digest:            utils.GetEnvVarBool("NotificationDigest", false),
+		certWarningPeriod: time.Duration(utils.GetEnvVarInt("CertExpiryWarningDays", 14)) * 24 * time.Hour,
+		digestWindow:      time.Duration(utils.GetEnvVarInt("NotificationDigestWindowInSeconds", 60)) * time.Second,
+		states:            map[string]*alertState{},
+		outbox:            make(chan []availabilityEvent, 16),
+	}
+	if utils.GetEnvVarString("PUSH_SERVICE", "") != "" {
+		ret.pusher = utils.GetNotificationPusher()
+	}
+	return ret
+}
+
+// evaluate updates the alert state of a target and returns the events to send
+func (a *availabilityNotifier) evaluate(name string, target Target, status TargetStatus) []availabilityEvent {
+	var state, exists = a.states[name]
+	if !exists {
+		state = &alertState{}
+		a.states[name] = state
+	}
+	var downThreshold, recoveryThreshold = a.downThreshold, a.recoveryThreshold
+	if target.DownThreshold > 0 {
+		downThreshold = target.DownThreshold
+	}
+	if target.RecoveryThreshold > 0 {
+		recoveryThreshold = target.RecoveryThreshold
+	}
+
+	var ret = []availabilityEvent{}
+	if status.Certificate != nil && time.Until(status.Certificate.NotAfter) < a.certWarningPeriod &&
+		!state.certWarned.Equal(status.Certificate.NotAfter) {
+		state.certWarned = status.Certificate.NotAfter
+		ret = append(ret, availabilityEvent{name: name, kind: eventCertExpiry, cert: status.Certificate})
+	}
+
+	if !status.Up && status.ConsecutiveFailures == 1 {
+		state.failingSince = status.CheckedAt
+	}
+	if !state.down && !status.Up && status.ConsecutiveFailures >= downThreshold {
+		state.down = true
+		state.notified = false
+	}
+	// recovery messages always follow a sent down message, only down messages
+	// are rate limited, a limited one is sent on a later check if still down
+	if state.down && !state.notified && !status.Up {
+		if status.CheckedAt.Sub(state.lastNotified) < a.minInterval {
+			return ret
+		}
+		state.notified = true
+		state.lastNotified = status.CheckedAt
+		return append(ret, availabilityEvent{name: name, kind: eventDown, since: state.failingSince, err: status.Error})
+	}
+	if state.down && status.Up && status.ConsecutiveSuccesses >= recoveryThreshold {
+		state.down = false
+		if !state.notified {
+			return ret
+		}
+		state.lastNotified = status.CheckedAt
+		return append(ret, availabilityEvent{name: name, kind: eventRecovered, since: state.failingSince, duration: status.CheckedAt.Sub(state.failingSince)})
+	}
+	return ret
+}
+
+func (a *availabilityNotifier) delete(name string) {
+	delete(a.states, name)
+}
+
+func (a *availabilityNotifier) queue(events []availabilityEvent, now time.Time) {
+	if len(events) == 0 {
+		return
+	}
+	if len(a.pending) == 0 {
+		a.pendingSince = now
+	}
+	a.pending = append(a.pending, events...)
+}
+
+// flush returns the pending events once they are due
+func (a *availabilityNotifier) flush(now time.Time) []availabilityEvent {
+	if flushAt, pending := a.nextFlush(); !pending || now.Before(flushAt) {
+		return nil
+	}
+	var ret = a.pending
+	a.pending = nil
+	return ret
+}
+
+func (a *availabilityNotifier) nextFlush() (time.Time, bool) {
+	if len(a.pending) == 0 {
+		return time.Time{}, false
+	}
+	if !a.digest {
+		return a.pendingSince, true
+	}
+	return a.pendingSince.Add(a.digestWindow), true
+}
+
+// send pushes the events, grouped into a single message in digest mode
+func (a *availabilityNotifier) send(events []availabilityEvent) error {
+	if a.pusher == nil || len(events) == 0 {
+		return nil
+	}
+	if !a.digest || len(events) == 1 {
+		for _, event := range events {
+			if err := a.pusher.Send(networkAvailabilityNotificationTitle, event.String(), a.priority); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var grouped = map[string][]string{}
+	for _, event := range events {
+		grouped[event.kind] = append(grouped[event.kind], event.String())
+	}
+	var lines = []string{}
+	for _, kind := range []string{eventDown, eventRecovered, eventCertExpiry} {
+		if len(grouped[kind]) == 0 {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%d targets %s:", len(grouped[kind]), kind))
+		lines = append(lines, grouped[kind]...)
+	}
+	return a.pusher.Send(networkAvailabilityNotificationTitle, strings.Join(lines, "\n"), a.priority)
+}
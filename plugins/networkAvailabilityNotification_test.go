@@ -0,0 +1,126 @@
+package plugins
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// checker feeds check results of one target to a notifier like the scheduler does
+type checker struct {
+	notifier  *availabilityNotifier
+	failures  int
+	successes int
+}
+
+func (c *checker) check(at time.Time, up bool) []string {
+	if up {
+		c.failures, c.successes = 0, c.successes+1
+	} else {
+		c.failures, c.successes = c.failures+1, 0
+	}
+	var status = TargetStatus{Up: up, CheckedAt: at, ConsecutiveFailures: c.failures, ConsecutiveSuccesses: c.successes}
+	if !up {
+		status.Error = "connection refused"
+	}
+	var kinds = []string{}
+	for _, event := range c.notifier.evaluate("router", Target{}, status) {
+		kinds = append(kinds, event.kind)
+	}
+	return kinds
+}
+
+func newTestNotifier() *availabilityNotifier {
+	return &availabilityNotifier{downThreshold: 1, recoveryThreshold: 1, minInterval: 10 * time.Minute, states: map[string]*alertState{}, outbox: make(chan []availabilityEvent, 1)}
+}
+
+func TestEvaluateDefersRateLimitedDown(t *testing.T) {
+	var c = &checker{notifier: newTestNotifier()}
+	var start = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var steps = []struct {
+		minutes int
+		up      bool
+		want    []string
+	}{
+		{0, false, []string{eventDown}},
+		{1, true, []string{eventRecovered}},
+		// down again within the min interval, held back
+		{2, false, nil},
+		{5, false, nil},
+		// still down once the interval passed
+		{11, false, []string{eventDown}},
+		{12, false, nil},
+		{13, true, []string{eventRecovered}},
+	}
+	for _, step := range steps {
+		var got = c.check(start.Add(time.Duration(step.minutes)*time.Minute), step.up)
+		if len(got) != len(step.want) || (len(got) == 1 && got[0] != step.want[0]) {
+			t.Errorf("minute %d up %v: got %q, want %q", step.minutes, step.up, got, step.want)
+		}
+	}
+}
+
+func TestEvaluateDropsDownRecoveredWithinInterval(t *testing.T) {
+	var c = &checker{notifier: newTestNotifier()}
+	var start = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.check(start, false)
+	c.check(start.Add(time.Minute), true)
+	// a short outage that was never announced is not announced as recovered
+	for _, minutes := range []int{2, 3} {
+		if got := c.check(start.Add(time.Duration(minutes)*time.Minute), minutes == 3); len(got) != 0 {
+			t.Errorf("minute %d: got %q, want no events", minutes, got)
+		}
+	}
+	if got := c.check(start.Add(20*time.Minute), true); len(got) != 0 {
+		t.Errorf("got %q, want no events", got)
+	}
+}
+
+// hungPusher blocks every push until released, like a push service that never answers
+type hungPusher struct {
+	release  chan struct{}
+	messages chan string
+}
+
+func (p *hungPusher) Send(title string, message string, priority int) error {
+	<-p.release
+	p.messages <- message
+	return nil
+}
+
+func TestHungPushDoesNotStallChecks(t *testing.T) {
+	var n = newTestAvailability(t)
+	var pusher = &hungPusher{release: make(chan struct{}), messages: make(chan string, 10)}
+	n.notifier.pusher = pusher
+	go n.notificationSending()
+	defer close(n.notifier.outbox)
+
+	var returned = make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			n.notifier.queue([]availabilityEvent{{name: "router", kind: eventDown}}, time.Now())
+			n.sendNotifications(time.Now())
+		}
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sending notifications blocked on the push")
+	}
+	close(pusher.release)
+	if message := <-pusher.messages; !strings.HasPrefix(message, "router is down") {
+		t.Errorf("got %q", message)
+	}
+}
+
+func TestCertExpiryMessage(t *testing.T) {
+	var expiring = availabilityEvent{name: "nas", kind: eventCertExpiry, cert: &CertificateStatus{Issuer: "CN=Ca", NotAfter: time.Now().Add(36 * time.Hour)}}
+	if got := expiring.String(); !strings.HasSuffix(got, "in 1 days") {
+		t.Errorf("got %q", got)
+	}
+	var expired = availabilityEvent{name: "nas", kind: eventCertExpiry, cert: &CertificateStatus{Issuer: "CN=Ca", NotAfter: time.Now().Add(-50 * time.Hour)}}
+	if got := expired.String(); !strings.Contains(got, "expired on") || !strings.HasSuffix(got, "2 days ago") {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,247 @@
+// blackbox_exporter compatible probe endpoint, scrape configs written for
+// /probe?target=...&module=... only need metrics_path set to
+// /networkavailability/probe, modules are http, tcp or dns profiles read from
+// ProbeModulesFile like
+//
+//	{
+//	    "http_2xx": {"prober": "http", "timeoutInSeconds": 5},
+//	    "http_post_auth": {"prober": "http", "http": {"method": "POST", "bearerTokenFile": "token", "validStatusCodes": [200, 204]}},
+//	    "tcp_connect": {"prober": "tcp"},
+//	    "dns_router": {"prober": "dns", "queryName": "router.lan", "queryType": "A"}
+//	}
+//
+// custom modules are added to the built-in http_2xx and tcp_connect, or replace
+// them when named alike, an http module is up on a 2xx unless validStatusCodes
+// is set
+
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type ProbeModule struct {
+	Prober           string `json:"prober"`
+	TimeoutInSeconds int    `json:"timeoutInSeconds,omitempty"`
+	// http prober, the url of the request is replaced by the probed target
+	Http Target `json:"http"`
+	// dns prober, the probed target is the dns server
+	QueryName string `json:"queryName,omitempty"`
+	QueryType string `json:"queryType,omitempty"`
+}
+
+var defaultProbeModules = map[string]ProbeModule{
+	"http_2xx":    {Prober: "http"},
+	"tcp_connect": {Prober: "tcp"},
+}
+
+type probeMetrics struct {
+	registry       *prometheus.Registry
+	success        prometheus.Gauge
+	duration       prometheus.Gauge
+	httpStatusCode prometheus.Gauge
+	sslExpiry      prometheus.Gauge
+	dnsAnswerRrs   prometheus.Gauge
+}
+
+func newProbeMetrics(prober string) *probeMetrics {
+	var ret = &probeMetrics{
+		registry: prometheus.NewRegistry(),
+		success:  prometheus.NewGauge(prometheus.GaugeOpts{Name: "probe_success", Help: "Displays whether or not the probe was a success"}),
+		duration: prometheus.NewGauge(prometheus.GaugeOpts{Name: "probe_duration_seconds", Help: "Returns how long the probe took to complete in seconds"}),
+	}
+	ret.registry.MustRegister(ret.success, ret.duration)
+	switch prober {
+	case "http":
+		ret.httpStatusCode = prometheus.NewGauge(prometheus.GaugeOpts{Name: "probe_http_status_code", Help: "Response HTTP status code"})
+		ret.sslExpiry = prometheus.NewGauge(prometheus.GaugeOpts{Name: "probe_ssl_earliest_cert_expiry", Help: "Returns earliest SSL cert expiry in unixtime"})
+		ret.registry.MustRegister(ret.httpStatusCode, ret.sslExpiry)
+	case "dns":
+		ret.dnsAnswerRrs = prometheus.NewGauge(prometheus.GaugeOpts{Name: "probe_dns_answer_rrs", Help: "Returns number of entries in the answer resource record list"})
+		ret.registry.MustRegister(ret.dnsAnswerRrs)
+	}
+	return ret
+}
+
+func (n *NetworkAvailability) loadProbeModules(filePath string) error {
+	n.probeModules = defaultProbeModules
+	var jsonBytes, err = ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var modules = map[string]ProbeModule{}
+	// a misplaced field would otherwise be ignored silently
+	var decoder = json.NewDecoder(bytes.NewReader(jsonBytes))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&modules); err != nil {
+		return err
+	}
+	for name, module := range modules {
+		if module.Prober != "http" && module.Prober != "tcp" && module.Prober != "dns" {
+			return fmt.Errorf("module %s has invalid prober %q", name, module.Prober)
+		}
+		if module.Prober == "http" {
+			if err = validateTargetRequest(module.Http); err != nil {
+				return fmt.Errorf("module %s is invalid: %s", name, err)
+			}
+		}
+		if module.Prober == "dns" && module.QueryName == "" {
+			return fmt.Errorf("module %s has no query name", name)
+		}
+		// an empty query type counts both A and AAAA answers
+		if module.Prober == "dns" && module.QueryType != "" && module.QueryType != "A" && module.QueryType != "AAAA" {
+			return fmt.Errorf("module %s has invalid query type %q, expecting A or AAAA", name, module.QueryType)
+		}
+	}
+	var merged = map[string]ProbeModule{}
+	for name, module := range defaultProbeModules {
+		merged[name] = module
+	}
+	for name, module := range modules {
+		merged[name] = module
+	}
+	n.probeModules = merged
+	return nil
+}
+
+func (n *NetworkAvailability) HandleProbe(rw http.ResponseWriter, req *http.Request) {
+	var queries = req.URL.Query()
+	var target = queries.Get("target")
+	var moduleName = queries.Get("module")
+	if moduleName == "" {
+		moduleName = "http_2xx"
+	}
+	if target == "" {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("target parameter is missing"))
+		return
+	}
+	var module, exists = n.probeModules[moduleName]
+	if !exists {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("unknown module %q", moduleName))
+		return
+	}
+
+	var timeout = time.Duration(module.TimeoutInSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	// leave some room for the response like blackbox_exporter does
+	if scrapeTimeout, err := strconv.ParseFloat(req.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64); err == nil {
+		var limit = time.Duration((scrapeTimeout - 0.5) * float64(time.Second))
+		if limit > 0 && limit < timeout {
+			timeout = limit
+		}
+	}
+	var ctx, cancel = context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+
+	var metrics = newProbeMetrics(module.Prober)
+	var start = time.Now()
+	var err error
+	switch module.Prober {
+	case "http":
+		err = n.probeHttp(ctx, target, module, metrics)
+	case "tcp":
+		err = probeTcp(ctx, target)
+	case "dns":
+		err = probeDns(ctx, target, module, metrics, timeout)
+	}
+	metrics.duration.Set(time.Since(start).Seconds())
+	if err != nil {
+		n.logger.Printf("probe of %s with module %s failed: %s", target, moduleName, err)
+	} else {
+		metrics.success.Set(1)
+	}
+	promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(rw, req)
+}
+
+func (n *NetworkAvailability) probeHttp(ctx context.Context, targetUrl string, module ProbeModule, metrics *probeMetrics) error {
+	if !strings.HasPrefix(targetUrl, "http://") && !strings.HasPrefix(targetUrl, "https://") {
+		targetUrl = "http://" + targetUrl
+	}
+	var target = module.Http
+	target.Url = targetUrl
+	var client, err = n.clientFor(target)
+	if err != nil {
+		return err
+	}
+	req, err := newTargetRequest(target)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	metrics.httpStatusCode.Set(float64(resp.StatusCode))
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		var earliest = resp.TLS.PeerCertificates[0].NotAfter
+		for _, cert := range resp.TLS.PeerCertificates {
+			if cert.NotAfter.Before(earliest) {
+				earliest = cert.NotAfter
+			}
+		}
+		metrics.sslExpiry.Set(float64(earliest.Unix()))
+	}
+
+	// blackbox_exporter takes a 2xx by default rather than any response
+	if len(target.ValidStatusCodes) == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return fmt.Errorf("invalid status code %d", resp.StatusCode)
+	}
+	if !target.validStatusCode(resp.StatusCode) {
+		return fmt.Errorf("invalid status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func probeTcp(ctx context.Context, target string) error {
+	var dialer = net.Dialer{}
+	var conn, err = dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func probeDns(ctx context.Context, server string, module ProbeModule, metrics *probeMetrics, timeout time.Duration) error {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	var resolver = newResolver(server, timeout)
+	var addrs, err = resolver.LookupIPAddr(ctx, module.QueryName)
+	if err != nil {
+		return err
+	}
+	var count = 0
+	for _, addr := range addrs {
+		var isIpv4 = addr.IP.To4() != nil
+		if (module.QueryType == "A" && !isIpv4) || (module.QueryType == "AAAA" && isIpv4) {
+			continue
+		}
+		count++
+	}
+	metrics.dnsAnswerRrs.Set(float64(count))
+	if count == 0 {
+		return fmt.Errorf("no %s record for %s", module.QueryType, module.QueryName)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package plugins
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadProbeModulesQueryType(t *testing.T) {
+	var tests = []struct {
+		queryType string
+		valid     bool
+	}{
+		{"", true},
+		{"A", true},
+		{"AAAA", true},
+		{"MX", false},
+		{"a", false},
+	}
+	for _, test := range tests {
+		var filePath = filepath.Join(t.TempDir(), "modules.json")
+		var content = `{"dns_router": {"prober": "dns", "queryName": "router.lan", "queryType": "` + test.queryType + `"}}`
+		if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var n = &NetworkAvailability{}
+		var err = n.loadProbeModules(filePath)
+		if (err == nil) != test.valid {
+			t.Errorf("query type %q: got error %v, want valid %t", test.queryType, err, test.valid)
+		}
+		if err != nil && n.probeModules["dns_router"].Prober != "" {
+			t.Errorf("query type %q: the invalid module was loaded", test.queryType)
+		}
+	}
+}
+
+func TestHandleProbeHttp(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/login" {
+			rw.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	var filePath = filepath.Join(t.TempDir(), "modules.json")
+	var content = `{"http_401": {"prober": "http", "http": {"validStatusCodes": [401]}}}`
+	if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var n = &NetworkAvailability{logger: log.New(ioutil.Discard, "", 0)}
+	if err := n.loadProbeModules(filePath); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		module  string
+		path    string
+		success string
+		code    string
+	}{
+		// http_2xx is still there besides the custom module
+		{"", "/", "probe_success 1", "probe_http_status_code 200"},
+		{"http_2xx", "/login", "probe_success 0", "probe_http_status_code 401"},
+		{"http_401", "/login", "probe_success 1", "probe_http_status_code 401"},
+		{"http_401", "/", "probe_success 0", "probe_http_status_code 200"},
+	}
+	for _, test := range tests {
+		var query = url.Values{"target": {server.URL + test.path}}
+		if test.module != "" {
+			query.Set("module", test.module)
+		}
+		var rw = httptest.NewRecorder()
+		n.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/probe?"+query.Encode(), nil))
+		var body = rw.Body.String()
+		if rw.Code != http.StatusOK || !strings.Contains(body, test.success+"\n") || !strings.Contains(body, test.code+"\n") {
+			t.Errorf("module %q on %s: got %d with\n%s\nwant %s and %s", test.module, test.path, rw.Code, body, test.success, test.code)
+		}
+	}
+}
+
+func TestLoadProbeModulesRejectsUnknownFields(t *testing.T) {
+	var filePath = filepath.Join(t.TempDir(), "modules.json")
+	var content = `{"http_401": {"prober": "http", "validStatusCodes": [401]}}`
+	if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var n = &NetworkAvailability{}
+	if err := n.loadProbeModules(filePath); err == nil {
+		t.Errorf("expected an error for validStatusCodes outside of http")
+	}
+}
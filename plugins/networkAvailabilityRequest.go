@@ -0,0 +1,318 @@
+// build the http request and client of a target from its optional method,
+// headers, auth, body and tls settings, secrets are read from files on every
+// check so they can be rotated without touching targets.json, any response
+// counts as up unless validStatusCodes is set, a Host header sets the host
+
+package plugins
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const redacted = "<redacted>"
+
+var sensitiveHeaderPattern = regexp.MustCompile(`(?i)(auth|token|key|secret|cookie|password)`)
+var httpMethodPattern = regexp.MustCompile(`^[A-Z]+$`)
+
+type BasicAuth struct {
+	Username     string `json:"username"`
+	PasswordFile string `json:"passwordFile"`
+}
+
+func (t Target) method() string {
+	if t.Method == "" {
+		return http.MethodGet
+	}
+	return t.Method
+}
+
+func (t Target) followRedirects() bool {
+	return t.FollowRedirects == nil || *t.FollowRedirects
+}
+
+// validStatusCode takes any response as up unless valid status codes are set,
+// so a login page answering 401 still counts
+func (t Target) validStatusCode(code int) bool {
+	if len(t.ValidStatusCodes) == 0 {
+		return true
+	}
+	for _, valid := range t.ValidStatusCodes {
+		if valid == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (t Target) needCustomClient() bool {
+	return t.CaFile != "" || t.InsecureSkipVerify || !t.followRedirects()
+}
+
+func validateTargetRequest(target Target) error {
+	if !httpMethodPattern.MatchString(target.method()) {
+		return fmt.Errorf("invalid method %q", target.Method)
+	}
+	for _, code := range target.ValidStatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid status code %d", code)
+		}
+	}
+	if target.BasicAuth != nil && target.BasicAuth.Username == "" {
+		return fmt.Errorf("basic auth username is empty")
+	}
+	if target.BasicAuth != nil && target.BearerTokenFile != "" {
+		return fmt.Errorf("basic auth and bearer token are exclusive")
+	}
+	for _, filePath := range []string{target.basicAuthPasswordFile(), target.BearerTokenFile, target.CaFile} {
+		if filePath == "" {
+			continue
+		}
+		if _, err := ioutil.ReadFile(filePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t Target) basicAuthPasswordFile() string {
+	if t.BasicAuth == nil {
+		return ""
+	}
+	return t.BasicAuth.PasswordFile
+}
+
+func readSecretFile(filePath string) (string, error) {
+	var content, err = ioutil.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+func newTargetRequest(target Target) (*http.Request, error) {
+	var body = strings.NewReader(target.Body)
+	var req, err = http.NewRequest(target.method(), target.Url, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range target.Headers {
+		// go sends req.Host rather than the header
+		if http.CanonicalHeaderKey(key) == "Host" {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(key, value)
+	}
+	if target.BasicAuth != nil {
+		var password, err = readSecretFile(target.BasicAuth.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read basic auth password: %s", err)
+		}
+		req.SetBasicAuth(target.BasicAuth.Username, password)
+	}
+	if target.BearerTokenFile != "" {
+		var token, err = readSecretFile(target.BearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bearer token: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+func targetTLSConfig(target Target) (*tls.Config, error) {
+	var tlsConfig = &tls.Config{InsecureSkipVerify: target.InsecureSkipVerify}
+	if target.CaFile != "" {
+		var pem, err = ioutil.ReadFile(target.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in ca file %q", target.CaFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+func setRedirectPolicy(client *http.Client, target Target) {
+	if !target.followRedirects() {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+}
+
+// newTargetClient returns nil when the shared clients can be used, record is
+// called with every tls handshake when set
+func (n *NetworkAvailability) newTargetClient(target Target, record func(tls.ConnectionState)) (*http.Client, error) {
+	if !target.needCustomClient() && record == nil {
+		return nil, nil
+	}
+	var tlsConfig, err = targetTLSConfig(target)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil {
+		recordHandshakes(tlsConfig, record)
+	}
+	// the default transport keeps the proxy from the environment and the dial timeouts
+	var transport = http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.DisableKeepAlives = true
+	if target.NeedProxy && n.httpClientWithProxy != nil {
+		transport.Proxy = http.ProxyURL(n.proxyUrl)
+	}
+	var client = &http.Client{Transport: transport}
+	setRedirectPolicy(client, target)
+	return client, nil
+}
+
+// clientFor falls back to the shared clients when the target needs no custom
+// one, it returns a copy with the timeout of the target, as checks run one
+// after another and a target that never answers would stall all of them
+func (n *NetworkAvailability) clientFor(target Target) (*http.Client, error) {
+	return n.recordingClientFor(target, nil)
+}
+
+// recordingClientFor is clientFor with a hook on every tls handshake, called
+// before the chain is verified
+func (n *NetworkAvailability) recordingClientFor(target Target, record func(tls.ConnectionState)) (*http.Client, error) {
+	var client, err = n.newTargetClient(target, record)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		var shared = *http.DefaultClient
+		if target.NeedProxy && n.httpClientWithProxy != nil {
+			shared = *n.httpClientWithProxy
+		}
+		client = &shared
+	}
+	client.Timeout = n.targetTimeout(target)
+	return client, nil
+}
+
+// redacted returns a copy safe to show, secret files are only shown by path
+func (t Target) redacted() Target {
+	t.Url = redactUrl(t.Url)
+	if t.Body != "" {
+		t.Body = redacted
+	}
+	if len(t.Headers) == 0 {
+		return t
+	}
+	var headers = map[string]string{}
+	for key, value := range t.Headers {
+		if sensitiveHeaderPattern.MatchString(key) {
+			value = redacted
+		}
+		headers[key] = value
+	}
+	t.Headers = headers
+	return t
+}
+
+// redactUrl masks the userinfo and the query values of a url, as they may
+// hold passwords or webhook tokens
+func redactUrl(rawUrl string) string {
+	var u, err = url.Parse(rawUrl)
+	if err != nil || (u.User == nil && u.RawQuery == "") {
+		return rawUrl
+	}
+	var hasUser = u.User != nil
+	var keys = []string{}
+	for key := range u.Query() {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	u.User, u.RawQuery, u.ForceQuery = nil, "", false
+	var ret = u.String()
+	if hasUser {
+		ret = strings.Replace(ret, "://", "://"+redacted+"@", 1)
+	}
+	for i, key := range keys {
+		var separator = "&"
+		if i == 0 {
+			separator = "?"
+		}
+		ret += separator + url.QueryEscape(key) + "=" + redacted
+	}
+	return ret
+}
+
+// restoreRedacted puts back the stored values of a target that was read with
+// GET and sent back with its placeholders
+func restoreRedacted(target Target, previous Target, exists bool) (Target, error) {
+	if strings.Contains(target.Url, redacted) {
+		if !exists || target.Url != redactUrl(previous.Url) {
+			return target, fmt.Errorf("url holds %s, set the actual url", redacted)
+		}
+		target.Url = previous.Url
+	}
+	if target.Body == redacted {
+		if !exists || previous.Body == "" {
+			return target, fmt.Errorf("body is %s, set the actual body", redacted)
+		}
+		target.Body = previous.Body
+	}
+	if len(target.Headers) == 0 {
+		return target, nil
+	}
+	var headers = map[string]string{}
+	for key, value := range target.Headers {
+		if value == redacted {
+			var stored, found = previous.Headers[key]
+			if !exists || !found {
+				return target, fmt.Errorf("header %s is %s, set the actual value", key, redacted)
+			}
+			value = stored
+		}
+		headers[key] = value
+	}
+	target.Headers = headers
+	return target, nil
+}
+
+func (t Target) describeRequest() string {
+	var parts = []string{fmt.Sprintf("%s %s", t.method(), redactUrl(t.Url))}
+	var safe = t.redacted()
+	var keys = []string{}
+	for key := range safe.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("header %s: %s", key, safe.Headers[key]))
+	}
+	if t.BasicAuth != nil {
+		parts = append(parts, fmt.Sprintf("basic auth %s:%s (from %s)", t.BasicAuth.Username, redacted, t.BasicAuth.PasswordFile))
+	}
+	if t.BearerTokenFile != "" {
+		parts = append(parts, fmt.Sprintf("bearer %s (from %s)", redacted, t.BearerTokenFile))
+	}
+	if t.Body != "" {
+		parts = append(parts, fmt.Sprintf("body of %d bytes", len(t.Body)))
+	}
+	if t.CaFile != "" {
+		parts = append(parts, fmt.Sprintf("ca file %s", t.CaFile))
+	}
+	parts = append(parts, fmt.Sprintf("proxy %t", t.NeedProxy))
+	parts = append(parts, fmt.Sprintf("insecure skip verify %t", t.InsecureSkipVerify))
+	parts = append(parts, fmt.Sprintf("follow redirects %t", t.followRedirects()))
+	if t.TimeoutInSeconds > 0 {
+		parts = append(parts, fmt.Sprintf("timeout %ds", t.TimeoutInSeconds))
+	}
+	if len(t.ValidStatusCodes) > 0 {
+		parts = append(parts, fmt.Sprintf("valid status codes %v", t.ValidStatusCodes))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,303 @@
+// rest api to list, add, update, delete and pause targets, changes are written
+// back to the targets file and picked up by the next round of checks, the file
+// is replaced by a rename, so in docker mount its directory rather than the
+// file, like -v /srv/rpi:/data -e TargetsFile=/data/targets.json
+//
+// GET masks secret headers, the body and the userinfo and query of the url
+// with <redacted>, a PUT that sends a placeholder back keeps the stored value
+//
+//	GET    /targets              list all targets
+//	GET    /targets/{name}       get one target
+//	POST   /targets/{name}       add a target
+//	PUT    /targets/{name}       add or update a target
+//	DELETE /targets/{name}       delete a target and its metric series
+//	POST   /targets/{name}/pause stop checking a target
+//	POST   /targets/{name}/resume
+
+package plugins
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"garfield/rpi-api-server/utils"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var targetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func validateTarget(name string, target Target) error {
+	if !targetNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid name %q, should match %s", name, targetNamePattern)
+	}
+	var u, err = url.Parse(target.Url)
+	if err != nil {
+		return fmt.Errorf("invalid url %q: %s", target.Url, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid url %q, scheme should be http or https", target.Url)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid url %q, host is empty", target.Url)
+	}
+	if target.DownThreshold < 0 || target.RecoveryThreshold < 0 {
+		return fmt.Errorf("thresholds should not be negative")
+	}
+	if target.IntervalInSeconds < 0 || target.RetryIntervalInSeconds < 0 {
+		return fmt.Errorf("intervals should not be negative")
+	}
+	if target.TimeoutInSeconds < 0 {
+		return fmt.Errorf("timeout should not be negative")
+	}
+	if target.Throughput != nil {
+		for _, throughputUrl := range []string{target.Throughput.DownloadUrl, target.Throughput.UploadUrl} {
+			if throughputUrl == "" {
+				continue
+			}
+			if u, err := url.Parse(throughputUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("invalid throughput url %q", throughputUrl)
+			}
+		}
+		if target.Throughput.MaxBytes < 0 || target.Throughput.MaxSeconds < 0 || target.Throughput.IntervalInSeconds < 0 {
+			return fmt.Errorf("throughput limits should not be negative")
+		}
+	}
+	return validateTargetRequest(target)
+}
+
+func (n *NetworkAvailability) loadTargets() error {
+	jsonBytes, err := ioutil.ReadFile(n.targetsFile)
+	if err != nil {
+		return err
+	}
+	var targets = map[string]Target{}
+	if err = json.Unmarshal(jsonBytes, &targets); err != nil {
+		return err
+	}
+	// headers and the body may hold secrets, so the targets are only described
+	for name, target := range targets {
+		n.logger.Printf("target %s: %s", name, target.describeRequest())
+		if err = validateTarget(name, target); err != nil {
+			n.logger.Printf("target %s is invalid: %s", name, err)
+		}
+	}
+	n.targets = targets
+	return nil
+}
+
+// saveTargets expects the lock to be held
+func (n *NetworkAvailability) saveTargets() error {
+	var jsonBytes, err = json.MarshalIndent(n.targets, "", "    ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomically(n.targetsFile, jsonBytes)
+}
+
+// snapshotTargets copies the targets so checks can run without holding the lock
+func (n *NetworkAvailability) snapshotTargets() map[string]Target {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	var ret = map[string]Target{}
+	for name, target := range n.targets {
+		ret[name] = target
+	}
+	return ret
+}
+
+// deleteTargetSeries expects the lock to be held
+func (n *NetworkAvailability) deleteTargetSeries(name string) {
+	n.gaugeVec.DeleteLabelValues(name)
+	n.deleteDiagnosisSeries(name)
+	for _, window := range uptimeWindows {
+		n.uptimeGaugeVec.DeleteLabelValues(name, window.name)
+	}
+	n.deleteCertificateSeries(name, n.statuses[name].Certificate)
+	delete(n.nextChecks, name)
+	n.deleteThroughputSeries(name)
+	delete(n.statuses, name)
+	n.history.delete(name)
+	n.notifier.delete(name)
+}
+
+// deleteDiagnosisSeries expects the lock to be held
+func (n *NetworkAvailability) deleteDiagnosisSeries(name string) {
+	for _, path := range n.diagnosisPaths {
+		n.pathGaugeVec.DeleteLabelValues(name, path.name)
+	}
+	for classification := range diagnosisDescriptions {
+		n.diagnosisGaugeVec.DeleteLabelValues(name, classification)
+	}
+	delete(n.diagnoses, name)
+}
+
+// deleteStaleSeries drops what an updated target no longer produces, it
+// expects the lock to be held
+func (n *NetworkAvailability) deleteStaleSeries(name string, previous Target, target Target) {
+	if !target.Diagnose && !n.diagnoseAllTargets {
+		n.deleteDiagnosisSeries(name)
+	}
+	if target.Throughput == nil {
+		n.deleteThroughputSeries(name)
+	} else if target.Throughput.UploadUrl == "" {
+		n.throughputGaugeVec.DeleteLabelValues(name, directionUpload)
+	}
+	// the last status and certificate belong to the old url
+	if target.Url != previous.Url {
+		n.deleteCertificateSeries(name, n.statuses[name].Certificate)
+		delete(n.statuses, name)
+	}
+}
+
+func (n *NetworkAvailability) HandleTargets(rw http.ResponseWriter, req *http.Request) {
+	var parts = strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/targets"), "/"), "/")
+	n.logger.Printf("got targets request from %q for %q using method %s", req.RemoteAddr, req.URL.Path, req.Method)
+	switch {
+	case parts[0] == "" && req.Method == http.MethodGet:
+		n.lock.Lock()
+		defer n.lock.Unlock()
+		var targets = map[string]Target{}
+		for name, target := range n.targets {
+			targets[name] = target.redacted()
+		}
+		writeJson(rw, http.StatusOK, targets)
+	case len(parts) == 1 && req.Method == http.MethodGet:
+		n.lock.Lock()
+		defer n.lock.Unlock()
+		var target, exists = n.targets[parts[0]]
+		if !exists {
+			writeError(rw, http.StatusNotFound, fmt.Errorf("target %q not found", parts[0]))
+			return
+		}
+		writeJson(rw, http.StatusOK, target.redacted())
+	case len(parts) == 1 && (req.Method == http.MethodPost || req.Method == http.MethodPut):
+		n.handleTargetUpsert(rw, req, parts[0])
+	case len(parts) == 1 && req.Method == http.MethodDelete:
+		n.handleTargetDelete(rw, parts[0])
+	case len(parts) == 2 && req.Method == http.MethodPost && (parts[1] == "pause" || parts[1] == "resume"):
+		n.handleTargetPause(rw, parts[0], parts[1] == "pause")
+	default:
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("invalid request: %s %s", req.Method, req.URL.Path))
+	}
+}
+
+func (n *NetworkAvailability) handleTargetUpsert(rw http.ResponseWriter, req *http.Request, name string) {
+	var target = Target{}
+	var body, err = ioutil.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err == nil {
+		err = json.Unmarshal(body, &target)
+	}
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("invalid target: %s", err))
+		return
+	}
+	n.lock.Lock()
+	var previous, exists = n.targets[name]
+	n.lock.Unlock()
+	if target, err = restoreRedacted(target, previous, exists); err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+	if err = validateTarget(name, target); err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	previous, exists = n.targets[name]
+	if exists && req.Method == http.MethodPost {
+		writeError(rw, http.StatusConflict, fmt.Errorf("target %q already exists", name))
+		return
+	}
+	n.targets[name] = target
+	if err = n.saveTargets(); err != nil {
+		if exists {
+			n.targets[name] = previous
+		} else {
+			delete(n.targets, name)
+		}
+		writeError(rw, http.StatusInternalServerError, fmt.Errorf("failed to save targets: %s", err))
+		return
+	}
+	if exists {
+		n.deleteStaleSeries(name, previous, target)
+	}
+	delete(n.nextChecks, name)
+	delete(n.nextThroughputChecks, name)
+	n.wakeUp()
+	n.logger.Printf("target %s saved at %s with proxy %t", name, redactUrl(target.Url), target.NeedProxy)
+	var status = http.StatusOK
+	if !exists {
+		status = http.StatusCreated
+	}
+	writeJson(rw, status, target.redacted())
+}
+
+func (n *NetworkAvailability) handleTargetDelete(rw http.ResponseWriter, name string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	var target, exists = n.targets[name]
+	if !exists {
+		writeError(rw, http.StatusNotFound, fmt.Errorf("target %q not found", name))
+		return
+	}
+	delete(n.targets, name)
+	if err := n.saveTargets(); err != nil {
+		n.targets[name] = target
+		writeError(rw, http.StatusInternalServerError, fmt.Errorf("failed to save targets: %s", err))
+		return
+	}
+	n.deleteTargetSeries(name)
+	n.logger.Printf("target %s deleted", name)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (n *NetworkAvailability) handleTargetPause(rw http.ResponseWriter, name string, paused bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	var target, exists = n.targets[name]
+	if !exists {
+		writeError(rw, http.StatusNotFound, fmt.Errorf("target %q not found", name))
+		return
+	}
+	var updated = target
+	updated.Paused = paused
+	n.targets[name] = updated
+	if err := n.saveTargets(); err != nil {
+		n.targets[name] = target
+		writeError(rw, http.StatusInternalServerError, fmt.Errorf("failed to save targets: %s", err))
+		return
+	}
+	if paused {
+		n.deleteThroughputSeries(name)
+	}
+	n.wakeUp()
+	n.logger.Printf("target %s paused: %t", name, paused)
+	writeJson(rw, http.StatusOK, updated.redacted())
+}
+
+func writeJson(rw http.ResponseWriter, status int, value interface{}) {
+	var buf = &bytes.Buffer{}
+	var encoder = json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(value); err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(rw, fmt.Sprintf("marshal error: %s\n", err))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(buf.Bytes())
+}
+
+func writeError(rw http.ResponseWriter, status int, err error) {
+	rw.WriteHeader(status)
+	io.WriteString(rw, fmt.Sprintf("%s\n", err))
+}
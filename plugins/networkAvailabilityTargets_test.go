@@ -0,0 +1,148 @@
+package plugins
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func serveTargets(n *NetworkAvailability, method string, path string, body string) *httptest.ResponseRecorder {
+	var rw = httptest.NewRecorder()
+	n.ServeHTTP(rw, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rw
+}
+
+func savedTargets(t *testing.T, n *NetworkAvailability) map[string]Target {
+	var targets = map[string]Target{}
+	var jsonBytes, err = ioutil.ReadFile(n.targetsFile)
+	if err == nil {
+		err = json.Unmarshal(jsonBytes, &targets)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return targets
+}
+
+func TestTargetsCreateAndConflict(t *testing.T) {
+	var n = newTestAvailability(t)
+	if rw := serveTargets(n, http.MethodPost, "/targets/nas", `{"url": "http://nas.lan"}`); rw.Code != http.StatusCreated {
+		t.Fatalf("got %d: %s", rw.Code, rw.Body)
+	}
+	if rw := serveTargets(n, http.MethodPost, "/targets/nas", `{"url": "http://other.lan"}`); rw.Code != http.StatusConflict {
+		t.Errorf("got %d for an existing target, want %d", rw.Code, http.StatusConflict)
+	}
+	if got := savedTargets(t, n)["nas"].Url; got != "http://nas.lan" {
+		t.Errorf("got url %q saved, want the first one", got)
+	}
+	if rw := serveTargets(n, http.MethodPost, "/targets/router", `{"url": "ftp://router.lan"}`); rw.Code != http.StatusBadRequest {
+		t.Errorf("got %d for an invalid target", rw.Code)
+	}
+}
+
+func TestTargetsUpdateDropsStaleSeries(t *testing.T) {
+	var n = newTestAvailability(t)
+	n.diagnosisPaths = buildDiagnosisPaths(nil, nil, time.Second)
+	if rw := serveTargets(n, http.MethodPut, "/targets/nas", `{"url": "http://nas.lan", "diagnose": true, "throughput": {"uploadUrl": "http://nas.lan/upload"}}`); rw.Code != http.StatusCreated {
+		t.Fatalf("got %d: %s", rw.Code, rw.Body)
+	}
+	n.exportDiagnosis("nas", Diagnosis{Classification: diagnosisOk, Paths: []PathResult{{Path: n.diagnosisPaths[0].name, Ok: true}}})
+	n.diagnoses["nas"] = Diagnosis{Classification: diagnosisOk}
+	n.throughputGaugeVec.WithLabelValues("nas", directionDownload).Set(10)
+	n.throughputGaugeVec.WithLabelValues("nas", directionUpload).Set(5)
+	n.throughputs["nas"] = ThroughputResult{DownloadMbps: 10, UploadMbps: 5}
+
+	if rw := serveTargets(n, http.MethodPut, "/targets/nas", `{"url": "http://nas.lan"}`); rw.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rw.Code, rw.Body)
+	}
+	if got := testutil.CollectAndCount(n.diagnosisGaugeVec) + testutil.CollectAndCount(n.pathGaugeVec); got != 0 {
+		t.Errorf("got %d diagnosis series after turning diagnose off, want none", got)
+	}
+	if got := testutil.CollectAndCount(n.throughputGaugeVec); got != 0 || len(n.diagnoses) != 0 || len(n.throughputs) != 0 {
+		t.Errorf("got %d throughput series, diagnoses %v and throughputs %v, want none", got, n.diagnoses, n.throughputs)
+	}
+}
+
+func TestTargetsDeleteRemovesSeries(t *testing.T) {
+	var n = newTestAvailability(t)
+	if rw := serveTargets(n, http.MethodPost, "/targets/nas", `{"url": "http://nas.lan"}`); rw.Code != http.StatusCreated {
+		t.Fatalf("got %d: %s", rw.Code, rw.Body)
+	}
+	n.processStatuses(time.Now(), map[string]TargetStatus{"nas": {Up: true}})
+	if got := testutil.CollectAndCount(n.gaugeVec); got != 1 {
+		t.Fatalf("got %d series after a check, want 1", got)
+	}
+	if rw := serveTargets(n, http.MethodDelete, "/targets/nas", ""); rw.Code != http.StatusNoContent {
+		t.Fatalf("got %d: %s", rw.Code, rw.Body)
+	}
+	if got := testutil.CollectAndCount(n.gaugeVec) + testutil.CollectAndCount(n.uptimeGaugeVec); got != 0 {
+		t.Errorf("got %d series after deleting, want none", got)
+	}
+	if _, exists := n.statuses["nas"]; exists || len(n.history.samples["nas"]) != 0 || len(savedTargets(t, n)) != 0 {
+		t.Errorf("the target was not deleted everywhere")
+	}
+	if rw := serveTargets(n, http.MethodDelete, "/targets/nas", ""); rw.Code != http.StatusNotFound {
+		t.Errorf("got %d deleting a missing target, want %d", rw.Code, http.StatusNotFound)
+	}
+}
+
+func TestTargetsPauseAndResume(t *testing.T) {
+	var n = newTestAvailability(t)
+	if rw := serveTargets(n, http.MethodPost, "/targets/nas", `{"url": "http://nas.lan"}`); rw.Code != http.StatusCreated {
+		t.Fatalf("got %d: %s", rw.Code, rw.Body)
+	}
+	n.throughputGaugeVec.WithLabelValues("nas", directionDownload).Set(10)
+	n.throughputs["nas"] = ThroughputResult{DownloadMbps: 10}
+	if rw := serveTargets(n, http.MethodPost, "/targets/nas/pause", ""); rw.Code != http.StatusOK || !savedTargets(t, n)["nas"].Paused {
+		t.Errorf("got %d, want the target saved as paused", rw.Code)
+	}
+	if got := testutil.CollectAndCount(n.throughputGaugeVec); got != 0 || len(n.throughputs) != 0 {
+		t.Errorf("got %d throughput series of a paused target, want none", got)
+	}
+	if rw := serveTargets(n, http.MethodPost, "/targets/nas/resume", ""); rw.Code != http.StatusOK || savedTargets(t, n)["nas"].Paused {
+		t.Errorf("got %d, want the target saved as resumed", rw.Code)
+	}
+	if rw := serveTargets(n, http.MethodPost, "/targets/missing/pause", ""); rw.Code != http.StatusNotFound {
+		t.Errorf("got %d pausing a missing target, want %d", rw.Code, http.StatusNotFound)
+	}
+}
+
+func TestTargetsRollbackWhenSaveFails(t *testing.T) {
+	var n = newTestAvailability(t)
+	n.targets["nas"] = Target{Url: "http://nas.lan"}
+	n.targetsFile = filepath.Join(t.TempDir(), "missing", "targets.json")
+	var requests = []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodPost, "/targets/router", `{"url": "http://router.lan"}`},
+		{http.MethodPut, "/targets/nas", `{"url": "http://other.lan"}`},
+		{http.MethodDelete, "/targets/nas", ""},
+		{http.MethodPost, "/targets/nas/pause", ""},
+	}
+	for _, request := range requests {
+		if rw := serveTargets(n, request.method, request.path, request.body); rw.Code != http.StatusInternalServerError {
+			t.Errorf("%s %s: got %d, want %d", request.method, request.path, rw.Code, http.StatusInternalServerError)
+		}
+		if len(n.targets) != 1 || !reflect.DeepEqual(n.targets["nas"], Target{Url: "http://nas.lan"}) {
+			t.Errorf("%s %s: got targets %+v, want them unchanged", request.method, request.path, n.targets)
+		}
+	}
+}
+
+func TestDiagnosisOfDeletedTargetNotExported(t *testing.T) {
+	var n = newTestAvailability(t)
+	n.runDiagnoses(map[string]Target{"gone": {Url: "http://127.0.0.1:1", Diagnose: true}})
+	if got := testutil.CollectAndCount(n.diagnosisGaugeVec); got != 0 || len(n.diagnoses) != 0 {
+		t.Errorf("got %d diagnosis series of a deleted target, want none", got)
+	}
+}
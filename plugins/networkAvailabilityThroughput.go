@@ -0,0 +1,249 @@
+// optional throughput test of a target, downloads from (and optionally uploads
+// to) a url until a byte cap or time cap is reached, with the headers and auth
+// of the target, runs on its own schedule so it does not eat bandwidth on every
+// check
+
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+const networkAvailabilityThroughputMetricName = "network_availability_throughput_mbps"
+const networkAvailabilityDirectionLabel = "direction"
+const directionDownload = "download"
+const directionUpload = "upload"
+
+var networkAvailabilityThroughputLables = []string{networkAvailabilityTargetLabel, networkAvailabilityDirectionLabel}
+
+type ThroughputConfig struct {
+	// defaults to the url of the target
+	DownloadUrl string `json:"downloadUrl,omitempty"`
+	// upload is skipped when empty, it should accept maxBytes within maxSeconds
+	UploadUrl         string `json:"uploadUrl,omitempty"`
+	MaxBytes          int64  `json:"maxBytes,omitempty"`
+	MaxSeconds        int    `json:"maxSeconds,omitempty"`
+	IntervalInSeconds int    `json:"intervalInSeconds,omitempty"`
+}
+
+type ThroughputResult struct {
+	Time          time.Time `json:"time"`
+	DownloadBytes int64     `json:"downloadBytes"`
+	DownloadMbps  float64   `json:"downloadMbps"`
+	UploadBytes   int64     `json:"uploadBytes,omitempty"`
+	UploadMbps    float64   `json:"uploadMbps,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	var n, err = c.reader.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func (c ThroughputConfig) limits() (int64, time.Duration) {
+	var maxBytes, maxDuration = c.MaxBytes, time.Duration(c.MaxSeconds) * time.Second
+	if maxBytes <= 0 {
+		maxBytes = 10 << 20
+	}
+	if maxDuration <= 0 {
+		maxDuration = 10 * time.Second
+	}
+	return maxBytes, maxDuration
+}
+
+func mbps(bytes int64, duration time.Duration) float64 {
+	if duration <= 0 {
+		return 0
+	}
+	return float64(bytes) * 8 / duration.Seconds() / 1e6
+}
+
+// measureDownload reads at most maxBytes, hitting the time cap is not an error
+func measureDownload(client *http.Client, req *http.Request, maxBytes int64, maxDuration time.Duration) (int64, time.Duration, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), maxDuration)
+	defer cancel()
+	var start = time.Now()
+	var resp, err = client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, time.Since(start), err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return 0, time.Since(start), fmt.Errorf("invalid status code %d", resp.StatusCode)
+	}
+	var counter = &countingReader{reader: resp.Body}
+	_, err = io.CopyN(ioutil.Discard, counter, maxBytes)
+	var elapsed = time.Since(start)
+	if err == io.EOF || (err != nil && ctx.Err() == context.DeadlineExceeded && counter.count > 0) {
+		err = nil
+	}
+	return counter.count, elapsed, err
+}
+
+// measureUpload posts maxBytes of zeros and times them from the written headers
+// until the response, as the bytes written before only reached the socket
+// buffer, an upload that does not finish within the time cap is an error, as
+// there is no telling how much of it the server read
+func measureUpload(client *http.Client, req *http.Request, maxBytes int64, maxDuration time.Duration) (int64, time.Duration, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), maxDuration)
+	defer cancel()
+	var counter = &countingReader{reader: io.LimitReader(zeroReader{}, maxBytes)}
+	req.Body, req.GetBody, req.ContentLength = ioutil.NopCloser(counter), nil, maxBytes
+	req.Header.Set("Content-Type", "application/octet-stream")
+	var wroteHeaders = make(chan time.Time, 1)
+	var trace = &httptrace.ClientTrace{WroteHeaders: func() {
+		select {
+		case wroteHeaders <- time.Now():
+		default:
+		}
+	}}
+	var start = time.Now()
+	var resp, err = client.Do(req.WithContext(httptrace.WithClientTrace(ctx, trace)))
+	select {
+	case start = <-wroteHeaders:
+	default:
+	}
+	var elapsed = time.Since(start)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return 0, elapsed, fmt.Errorf("upload of %d bytes did not finish within %s, lower maxBytes", maxBytes, maxDuration)
+		}
+		return 0, elapsed, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return 0, elapsed, fmt.Errorf("invalid status code %d", resp.StatusCode)
+	}
+	return maxBytes, elapsed, nil
+}
+
+// throughputRequest sends the headers and auth of the target to a test url
+func throughputRequest(target Target, method string, testUrl string) (*http.Request, error) {
+	target.Url, target.Method, target.Body = testUrl, method, ""
+	return newTargetRequest(target)
+}
+
+func (n *NetworkAvailability) measureThroughput(name string, target Target) ThroughputResult {
+	var config = *target.Throughput
+	var result = ThroughputResult{Time: time.Now()}
+	var client, err = n.clientFor(target)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	var maxBytes, maxDuration = config.limits()
+	// the time cap ends the measurement, the timeout only bounds a request that hangs
+	client.Timeout += maxDuration
+	var downloadUrl = config.DownloadUrl
+	if downloadUrl == "" {
+		downloadUrl = target.Url
+	}
+	n.logger.Printf("measuring download throughput of %s from %s", name, redactUrl(downloadUrl))
+	req, err := throughputRequest(target, http.MethodGet, downloadUrl)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	bytes, elapsed, err := measureDownload(client, req, maxBytes, maxDuration)
+	result.DownloadBytes, result.DownloadMbps = bytes, mbps(bytes, elapsed)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if config.UploadUrl != "" {
+		n.logger.Printf("measuring upload throughput of %s to %s", name, redactUrl(config.UploadUrl))
+		if req, err = throughputRequest(target, http.MethodPost, config.UploadUrl); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		bytes, elapsed, err = measureUpload(client, req, maxBytes, maxDuration)
+		result.UploadBytes, result.UploadMbps = bytes, mbps(bytes, elapsed)
+		if err != nil {
+			result.Error = err.Error()
+		}
+	}
+	return result
+}
+
+func (n *NetworkAvailability) throughputInterval(config ThroughputConfig) time.Duration {
+	if config.IntervalInSeconds > 0 {
+		return time.Duration(config.IntervalInSeconds) * time.Second
+	}
+	return time.Duration(n.throughputIntervalInSeconds) * time.Second
+}
+
+// throughputScheduling runs apart from the checks, so a slow test does not delay them
+func (n *NetworkAvailability) throughputScheduling() {
+	for {
+		var now = time.Now()
+		var wakeUp = now.Add(time.Minute)
+		var due = map[string]Target{}
+		n.lock.Lock()
+		for name, target := range n.targets {
+			if target.Paused || target.Throughput == nil {
+				delete(n.nextThroughputChecks, name)
+				continue
+			}
+			var next, scheduled = n.nextThroughputChecks[name]
+			if !scheduled {
+				var interval = n.throughputInterval(*target.Throughput)
+				next = now.Add(n.jitter(interval))
+				n.nextThroughputChecks[name] = next
+			}
+			if !next.After(now) {
+				due[name] = target
+			} else if next.Before(wakeUp) {
+				wakeUp = next
+			}
+		}
+		n.lock.Unlock()
+
+		for name, target := range due {
+			var result = n.measureThroughput(name, target)
+			n.logger.Printf("throughput of %s is %.2f Mbps down, %.2f Mbps up, error %q", name, result.DownloadMbps, result.UploadMbps, result.Error)
+			n.lock.Lock()
+			// deleted, paused or without a test any more while being measured
+			if current, exists := n.targets[name]; exists && !current.Paused && current.Throughput != nil {
+				n.throughputs[name] = result
+				n.throughputGaugeVec.WithLabelValues(name, directionDownload).Set(result.DownloadMbps)
+				if current.Throughput.UploadUrl != "" {
+					n.throughputGaugeVec.WithLabelValues(name, directionUpload).Set(result.UploadMbps)
+				}
+				var interval = n.throughputInterval(*current.Throughput)
+				n.nextThroughputChecks[name] = time.Now().Add(interval + n.jitter(interval))
+			}
+			n.lock.Unlock()
+		}
+		if len(due) == 0 {
+			time.Sleep(time.Until(wakeUp))
+		}
+	}
+}
+
+func (n *NetworkAvailability) deleteThroughputSeries(name string) {
+	n.throughputGaugeVec.DeleteLabelValues(name, directionDownload)
+	n.throughputGaugeVec.DeleteLabelValues(name, directionUpload)
+	delete(n.throughputs, name)
+	delete(n.nextThroughputChecks, name)
+}
@@ -0,0 +1,134 @@
+package plugins
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newRequest(t *testing.T, method string, url string) *http.Request {
+	var req, err = http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// stall writes the first bytes and then waits for the client to give up
+func stall(rw http.ResponseWriter, req *http.Request) {
+	io.WriteString(rw, strings.Repeat("x", 1000))
+	rw.(http.Flusher).Flush()
+	select {
+	case <-req.Context().Done():
+	case <-time.After(5 * time.Second):
+	}
+}
+
+func TestMeasureDownloadByteCap(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, strings.Repeat("x", 1<<20))
+	}))
+	defer server.Close()
+	var bytes, _, err = measureDownload(server.Client(), newRequest(t, http.MethodGet, server.URL), 1000, 5*time.Second)
+	if err != nil || bytes != 1000 {
+		t.Errorf("got %d bytes and error %v, want 1000 bytes", bytes, err)
+	}
+	bytes, _, err = measureDownload(server.Client(), newRequest(t, http.MethodGet, server.URL), 10<<20, 5*time.Second)
+	if err != nil || bytes != 1<<20 {
+		t.Errorf("got %d bytes and error %v, want the whole body", bytes, err)
+	}
+}
+
+func TestMeasureDownloadTimeCap(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(stall))
+	defer server.Close()
+	var bytes, elapsed, err = measureDownload(server.Client(), newRequest(t, http.MethodGet, server.URL), 1<<20, 200*time.Millisecond)
+	if err != nil || bytes != 1000 {
+		t.Errorf("got %d bytes and error %v, want the partial 1000 bytes", bytes, err)
+	}
+	if elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("expected to stop at the time cap, took %s", elapsed)
+	}
+}
+
+func TestMeasureDownloadTimeCapWithoutBytes(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+	var bytes, _, err = measureDownload(server.Client(), newRequest(t, http.MethodGet, server.URL), 1<<20, 200*time.Millisecond)
+	if err == nil || bytes != 0 {
+		t.Errorf("got %d bytes and error %v, want an error", bytes, err)
+	}
+}
+
+func TestMeasureUpload(t *testing.T) {
+	var received = make(chan int, 1)
+	var server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body, _ = ioutil.ReadAll(req.Body)
+		received <- len(body)
+	}))
+	defer server.Close()
+	var bytes, _, err = measureUpload(server.Client(), newRequest(t, http.MethodPost, server.URL), 100000, 5*time.Second)
+	if err != nil || bytes != 100000 {
+		t.Errorf("got %d bytes and error %v, want 100000 bytes", bytes, err)
+	}
+	if got := <-received; got != 100000 {
+		t.Errorf("server received %d bytes, want 100000", got)
+	}
+}
+
+func TestMeasureUploadTimeCap(t *testing.T) {
+	// the server does not notice the client giving up while it is not reading
+	var release = make(chan struct{})
+	var server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.CopyN(ioutil.Discard, req.Body, 1000)
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	var bytes, elapsed, err = measureUpload(server.Client(), newRequest(t, http.MethodPost, server.URL), 1<<30, 200*time.Millisecond)
+	if err == nil || bytes != 0 {
+		t.Errorf("got %d bytes and error %v, want an error rather than the bytes in the socket buffer", bytes, err)
+	}
+	if elapsed > 2*time.Second {
+		t.Errorf("expected to stop at the time cap, took %s", elapsed)
+	}
+}
+
+func TestMeasureThroughputSendsTargetAuth(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.Method == http.MethodPost {
+			io.Copy(ioutil.Discard, req.Body)
+			return
+		}
+		io.WriteString(rw, strings.Repeat("x", 100000))
+	}))
+	defer server.Close()
+	var n = newTestAvailability(t)
+	var target = Target{
+		Url:        server.URL,
+		Method:     http.MethodHead,
+		Headers:    map[string]string{"Authorization": "Bearer secret"},
+		Throughput: &ThroughputConfig{UploadUrl: server.URL + "/upload", MaxBytes: 100000},
+	}
+	var result = n.measureThroughput("nas", target)
+	if result.Error != "" || result.DownloadBytes != 100000 || result.UploadBytes != 100000 {
+		t.Errorf("got %+v, want both directions measured", result)
+	}
+	target.Headers = nil
+	if result = n.measureThroughput("nas", target); result.Error != "invalid status code 401" {
+		t.Errorf("got %+v, want the 401 as an error", result)
+	}
+}
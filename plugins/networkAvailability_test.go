@@ -0,0 +1,100 @@
+package plugins
+
+import (
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newTestAvailability returns a plugin like Start does, with unregistered
+// metrics and its files in a temporary directory
+func newTestAvailability(t *testing.T) *NetworkAvailability {
+	var dir = t.TempDir()
+	var history, _ = loadAvailabilityHistory(filepath.Join(dir, "history.json"), 1000)
+	var gaugeVec = func(name string, labels []string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name}, labels)
+	}
+	return &NetworkAvailability{
+		logger:                   log.New(ioutil.Discard, "", 0),
+		targetsFile:              filepath.Join(dir, "targets.json"),
+		targets:                  map[string]Target{},
+		gaugeVec:                 gaugeVec("test_availability", networkAvailabilityLables),
+		pathGaugeVec:             gaugeVec("test_path", networkAvailabilityPathLables),
+		diagnosisGaugeVec:        gaugeVec("test_diagnosis", networkAvailabilityDiagnosisLables),
+		uptimeGaugeVec:           gaugeVec("test_uptime", networkAvailabilityUptimeLables),
+		certExpiryGaugeVec:       gaugeVec("test_cert_expiry", networkAvailabilityCertLables),
+		certValidGaugeVec:        gaugeVec("test_cert_valid", networkAvailabilityCertLables),
+		certInfoGaugeVec:         gaugeVec("test_cert_info", networkAvailabilityCertInfoLables),
+		throughputGaugeVec:       gaugeVec("test_throughput", networkAvailabilityThroughputLables),
+		refreshIntervalInSeconds: 300,
+		retryIntervalInSeconds:   60,
+		checkTimeout:             5 * time.Second,
+		random:                   rand.New(rand.NewSource(1)),
+		nextChecks:               map[string]time.Time{},
+		nextThroughputChecks:     map[string]time.Time{},
+		wakeChan:                 make(chan struct{}, 1),
+		statuses:                 map[string]TargetStatus{},
+		diagnoses:                map[string]Diagnosis{},
+		throughputs:              map[string]ThroughputResult{},
+		history:                  history,
+		notifier:                 newTestNotifier(),
+	}
+}
+
+func TestRefreshWithoutScheduler(t *testing.T) {
+	var n = newTestAvailability(t)
+	var rw = httptest.NewRecorder()
+	n.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/refresh", nil))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want %d", rw.Code, http.StatusServiceUnavailable)
+	}
+}
+
+// stalledWriter blocks writes until released, like a client that stopped reading
+type stalledWriter struct {
+	*httptest.ResponseRecorder
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	select {
+	case <-w.writing:
+	default:
+		close(w.writing)
+	}
+	<-w.release
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestStatusPageWrittenWithoutLock(t *testing.T) {
+	var n = newTestAvailability(t)
+	n.targets["nas"] = Target{Url: "http://nas.lan"}
+	var rw = &stalledWriter{ResponseRecorder: httptest.NewRecorder(), writing: make(chan struct{}), release: make(chan struct{})}
+	var done = make(chan struct{})
+	go func() {
+		n.HandleStatusPage(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+		close(done)
+	}()
+	<-rw.writing
+	var locked = make(chan struct{})
+	go func() {
+		n.lock.Lock()
+		n.lock.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Errorf("the lock is held while writing to the client")
+	}
+	close(rw.release)
+	<-done
+}
@@ -0,0 +1,301 @@
+// traffic and error statistics of the network interfaces, like the wan link as
+// a whole, read on scrape from PROC_NET_DEV_FILE and SYS_CLASS_NET_DIR, so both
+// can point to a copied directory, counters come from /proc/net/dev or else
+// from the statistics of sysfs, link speed, operstate and carrier changes from
+// sysfs, INTERFACES_INCLUDE and INTERFACES_EXCLUDE are comma separated globs
+// like "eth*,wlan0", an interface is exported when it matches an include, or
+// there are none, and no exclude
+
+package plugins
+
+import (
+	"fmt"
+	"garfield/rpi-api-server/utils"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const interfaceLabel = "interface"
+const operStateLabel = "operstate"
+
+const directionReceive = "receive"
+const directionTransmit = "transmit"
+
+type InterfaceCounters struct {
+	Bytes   float64
+	Packets float64
+	Errors  float64
+	Drops   float64
+}
+
+type InterfaceStatistics struct {
+	Name     string
+	Receive  InterfaceCounters
+	Transmit InterfaceCounters
+	// in bytes per second, -1 when unknown as for wifi or a link that is down
+	Speed          float64
+	OperState      string
+	Carrier        float64
+	CarrierChanges float64
+	// the counters were read from sysfs as the interface is not in /proc/net/dev
+	FromSysfs bool
+}
+
+type NetworkInterfaces struct {
+	procNetDevFile string
+	sysClassNetDir string
+	includes       []string
+	excludes       []string
+	logger         *log.Logger
+
+	bytesDesc          *prometheus.Desc
+	packetsDesc        *prometheus.Desc
+	errorsDesc         *prometheus.Desc
+	dropsDesc          *prometheus.Desc
+	speedDesc          *prometheus.Desc
+	upDesc             *prometheus.Desc
+	carrierDesc        *prometheus.Desc
+	carrierChangesDesc *prometheus.Desc
+}
+
+func splitPatterns(value string) []string {
+	var ret = []string{}
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			panic(fmt.Sprintf("invalid interface pattern %q: %s", pattern, err))
+		}
+		ret = append(ret, pattern)
+	}
+	return ret
+}
+
+func (n *NetworkInterfaces) Start() {
+	n.logger = utils.GetLogger("NetworkInterfaces")
+
+	n.procNetDevFile = utils.GetEnvVarString("PROC_NET_DEV_FILE", "/proc/net/dev")
+	n.logger.Printf("PROC_NET_DEV_FILE: %q", n.procNetDevFile)
+	n.sysClassNetDir = utils.GetEnvVarString("SYS_CLASS_NET_DIR", "/sys/class/net")
+	n.logger.Printf("SYS_CLASS_NET_DIR: %q", n.sysClassNetDir)
+	n.includes = splitPatterns(utils.GetEnvVarString("INTERFACES_INCLUDE", ""))
+	n.logger.Printf("INTERFACES_INCLUDE: %q", n.includes)
+	n.excludes = splitPatterns(utils.GetEnvVarString("INTERFACES_EXCLUDE", "lo"))
+	n.logger.Printf("INTERFACES_EXCLUDE: %q", n.excludes)
+
+	var labels = []string{interfaceLabel, directionLabel}
+	n.bytesDesc = prometheus.NewDesc("network_interface_bytes_total", "bytes received or transmitted by the interface", labels, nil)
+	n.packetsDesc = prometheus.NewDesc("network_interface_packets_total", "packets received or transmitted by the interface", labels, nil)
+	n.errorsDesc = prometheus.NewDesc("network_interface_errors_total", "receive or transmit errors of the interface", labels, nil)
+	n.dropsDesc = prometheus.NewDesc("network_interface_drops_total", "packets dropped while receiving or transmitting by the interface", labels, nil)
+	n.speedDesc = prometheus.NewDesc("network_interface_speed_bytes_per_second", "negotiated link speed of the interface", []string{interfaceLabel}, nil)
+	n.upDesc = prometheus.NewDesc("network_interface_up", "1 when the operstate of the interface is up", []string{interfaceLabel, operStateLabel}, nil)
+	n.carrierDesc = prometheus.NewDesc("network_interface_carrier", "1 when the interface has a carrier", []string{interfaceLabel}, nil)
+	n.carrierChangesDesc = prometheus.NewDesc("network_interface_carrier_changes_total", "times the carrier of the interface went up or down", []string{interfaceLabel}, nil)
+	n.logger.Printf("registering network interface collector")
+	prometheus.MustRegister(n)
+}
+
+func (n *NetworkInterfaces) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var stats, err = n.ReadInterfaces()
+	rw.WriteHeader(http.StatusOK)
+	io.WriteString(rw, fmt.Sprintf("proc net dev file: %s\n", n.procNetDevFile))
+	io.WriteString(rw, fmt.Sprintf("sys class net dir: %s\n", n.sysClassNetDir))
+	io.WriteString(rw, fmt.Sprintf("includes: %q\n", n.includes))
+	io.WriteString(rw, fmt.Sprintf("excludes: %q\n", n.excludes))
+	if err != nil {
+		io.WriteString(rw, fmt.Sprintf("error: %s\n", err))
+		return
+	}
+	for _, stat := range stats {
+		io.WriteString(rw, fmt.Sprintf(`
+%s: operstate %s, carrier %.0f, carrier changes %.0f, speed %s, from sysfs %t
+  receive:  %s in %.0f packets, %.0f errors, %.0f drops
+  transmit: %s in %.0f packets, %.0f errors, %.0f drops
+`, stat.Name, stat.OperState, stat.Carrier, stat.CarrierChanges, formatSpeed(stat.Speed), stat.FromSysfs,
+			formatBytes(stat.Receive.Bytes), stat.Receive.Packets, stat.Receive.Errors, stat.Receive.Drops,
+			formatBytes(stat.Transmit.Bytes), stat.Transmit.Packets, stat.Transmit.Errors, stat.Transmit.Drops))
+	}
+}
+
+func formatSpeed(speed float64) string {
+	if speed < 0 {
+		return "unknown"
+	}
+	return formatBytes(speed) + "/s"
+}
+
+func (n *NetworkInterfaces) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{n.bytesDesc, n.packetsDesc, n.errorsDesc, n.dropsDesc, n.speedDesc, n.upDesc, n.carrierDesc, n.carrierChangesDesc} {
+		ch <- desc
+	}
+}
+
+func (n *NetworkInterfaces) Collect(ch chan<- prometheus.Metric) {
+	var stats, err = n.ReadInterfaces()
+	if err != nil {
+		n.logger.Printf("failed to read interfaces: %s", err)
+		return
+	}
+	for _, stat := range stats {
+		for _, direction := range []struct {
+			name     string
+			counters InterfaceCounters
+		}{{directionReceive, stat.Receive}, {directionTransmit, stat.Transmit}} {
+			ch <- prometheus.MustNewConstMetric(n.bytesDesc, prometheus.CounterValue, direction.counters.Bytes, stat.Name, direction.name)
+			ch <- prometheus.MustNewConstMetric(n.packetsDesc, prometheus.CounterValue, direction.counters.Packets, stat.Name, direction.name)
+			ch <- prometheus.MustNewConstMetric(n.errorsDesc, prometheus.CounterValue, direction.counters.Errors, stat.Name, direction.name)
+			ch <- prometheus.MustNewConstMetric(n.dropsDesc, prometheus.CounterValue, direction.counters.Drops, stat.Name, direction.name)
+		}
+		if stat.Speed >= 0 {
+			ch <- prometheus.MustNewConstMetric(n.speedDesc, prometheus.GaugeValue, stat.Speed, stat.Name)
+		}
+		var up = 0.0
+		if stat.OperState == "up" {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(n.upDesc, prometheus.GaugeValue, up, stat.Name, stat.OperState)
+		if stat.Carrier >= 0 {
+			ch <- prometheus.MustNewConstMetric(n.carrierDesc, prometheus.GaugeValue, stat.Carrier, stat.Name)
+		}
+		if stat.CarrierChanges >= 0 {
+			ch <- prometheus.MustNewConstMetric(n.carrierChangesDesc, prometheus.CounterValue, stat.CarrierChanges, stat.Name)
+		}
+	}
+}
+
+func (n *NetworkInterfaces) isIncluded(name string) bool {
+	var matches = func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, name); matched {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(n.includes) == 0 || matches(n.includes)) && !matches(n.excludes)
+}
+
+// ReadInterfaces lists the interfaces of /proc/net/dev and of sysfs sorted by
+// name, only failing when neither can be read
+func (n *NetworkInterfaces) ReadInterfaces() ([]InterfaceStatistics, error) {
+	var byName = map[string]*InterfaceStatistics{}
+	var content, procErr = ioutil.ReadFile(n.procNetDevFile)
+	if procErr == nil {
+		for _, stat := range parseProcNetDev(string(content)) {
+			var current = stat
+			byName[stat.Name] = &current
+		}
+	}
+	var entries, sysErr = ioutil.ReadDir(n.sysClassNetDir)
+	if procErr != nil && sysErr != nil {
+		return nil, fmt.Errorf("%s, %s", procErr, sysErr)
+	}
+	for _, entry := range entries {
+		if _, exists := byName[entry.Name()]; exists {
+			continue
+		}
+		// sysfs also lists files like bonding_masters
+		if _, err := os.Stat(filepath.Join(n.sysClassNetDir, entry.Name(), "statistics")); err == nil {
+			byName[entry.Name()] = &InterfaceStatistics{Name: entry.Name(), FromSysfs: true}
+		}
+	}
+	var ret = []InterfaceStatistics{}
+	for name, stat := range byName {
+		if !n.isIncluded(name) {
+			continue
+		}
+		n.readSysfs(stat)
+		ret = append(ret, *stat)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, nil
+}
+
+// readSysfs adds the link details, files that are missing or unreadable, like
+// the speed of a link that is down, are -1
+func (n *NetworkInterfaces) readSysfs(stat *InterfaceStatistics) {
+	var dir = filepath.Join(n.sysClassNetDir, stat.Name)
+	var read = func(name string) float64 {
+		var content, err = ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return -1
+		}
+		var value, parseErr = strconv.ParseFloat(strings.TrimSpace(string(content)), 64)
+		if parseErr != nil {
+			return -1
+		}
+		return value
+	}
+	stat.Speed = read("speed")
+	if stat.Speed > 0 {
+		// in Mbit/s
+		stat.Speed = stat.Speed * 1000 * 1000 / 8
+	} else {
+		stat.Speed = -1
+	}
+	stat.Carrier = read("carrier")
+	stat.CarrierChanges = read("carrier_changes")
+	stat.OperState = "unknown"
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "operstate")); err == nil {
+		stat.OperState = strings.TrimSpace(string(content))
+	}
+	if !stat.FromSysfs {
+		return
+	}
+	var counter = func(name string) float64 {
+		return math.Max(read(filepath.Join("statistics", name)), 0)
+	}
+	stat.Receive = InterfaceCounters{Bytes: counter("rx_bytes"), Packets: counter("rx_packets"), Errors: counter("rx_errors"), Drops: counter("rx_dropped")}
+	stat.Transmit = InterfaceCounters{Bytes: counter("tx_bytes"), Packets: counter("tx_packets"), Errors: counter("tx_errors"), Drops: counter("tx_dropped")}
+}
+
+// parseProcNetDev reads lines like
+// "  eth0: 1234 56 0 0 0 0 0 0 4321 65 0 0 0 0 0 0" after two header lines,
+// receive bytes, packets, errs and drop are the first four fields and transmit
+// ones the first four after eight
+func parseProcNetDev(content string) []InterfaceStatistics {
+	var ret = []InterfaceStatistics{}
+	for _, line := range strings.Split(content, "\n") {
+		var idx = strings.Index(line, ":")
+		if idx < 0 {
+			continue
+		}
+		var fields = strings.Fields(line[idx+1:])
+		if len(fields) < 12 {
+			continue
+		}
+		var values = make([]float64, 12)
+		var valid = true
+		for i := range values {
+			var value, err = strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				valid = false
+				break
+			}
+			values[i] = value
+		}
+		if !valid {
+			continue
+		}
+		ret = append(ret, InterfaceStatistics{
+			Name:     strings.TrimSpace(line[:idx]),
+			Receive:  InterfaceCounters{Bytes: values[0], Packets: values[1], Errors: values[2], Drops: values[3]},
+			Transmit: InterfaceCounters{Bytes: values[8], Packets: values[9], Errors: values[10], Drops: values[11]},
+		})
+	}
+	return ret
+}
@@ -0,0 +1,127 @@
+package plugins
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const fakeProcNetDev = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:    5000      50    0    0    0     0          0         0     5000      50    0    0    0     0       0          0
+  eth0: 123456789  100000    2    7    0     0          0         0 98765432   90000    1    0    0     0       0          0
+  eth1:    1000      10    0    0    0     0          0         0     2000      20    0    0    0     0       0          0
+ wlan0:    3000      30    0    0    0     0          0         0     4000      40    0    0    0     0       0          0
+`
+
+// fakeNetDirs builds /proc/net/dev and /sys/class/net with eth0 up at 1Gbit/s,
+// eth1 down, wlan0 and lo, and usb0 which is only in sysfs
+func fakeNetDirs(t *testing.T) (string, string) {
+	var root = t.TempDir()
+	var write = func(path string, content string) {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("proc/net/dev", fakeProcNetDev)
+	for _, name := range []string{"lo", "eth0", "eth1", "wlan0", "usb0"} {
+		write("sys/class/net/"+name+"/statistics/rx_bytes", "999999\n")
+	}
+	write("sys/class/net/eth0/speed", "1000\n")
+	write("sys/class/net/eth0/operstate", "up\n")
+	write("sys/class/net/eth0/carrier", "1\n")
+	write("sys/class/net/eth0/carrier_changes", "3\n")
+	// the kernel reports the speed of a link without carrier as -1
+	write("sys/class/net/eth1/speed", "-1\n")
+	write("sys/class/net/eth1/operstate", "down\n")
+	write("sys/class/net/eth1/carrier_changes", "8\n")
+	write("sys/class/net/usb0/operstate", "up\n")
+	for name, value := range map[string]string{"rx_bytes": "11", "rx_packets": "2", "rx_errors": "0", "rx_dropped": "1", "tx_bytes": "22", "tx_packets": "3", "tx_errors": "4", "tx_dropped": "0"} {
+		write("sys/class/net/usb0/statistics/"+name, value+"\n")
+	}
+	write("sys/class/net/bonding_masters", "\n")
+	return filepath.Join(root, "proc/net/dev"), filepath.Join(root, "sys/class/net")
+}
+
+func TestReadInterfaces(t *testing.T) {
+	var procNetDev, sysClassNet = fakeNetDirs(t)
+	var n = &NetworkInterfaces{procNetDevFile: procNetDev, sysClassNetDir: sysClassNet, excludes: []string{"lo", "wl*"}}
+	var stats, err = n.ReadInterfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want = []InterfaceStatistics{
+		{
+			Name:     "eth0",
+			Receive:  InterfaceCounters{Bytes: 123456789, Packets: 100000, Errors: 2, Drops: 7},
+			Transmit: InterfaceCounters{Bytes: 98765432, Packets: 90000, Errors: 1},
+			Speed:    125000000, OperState: "up", Carrier: 1, CarrierChanges: 3,
+		},
+		{
+			Name:     "eth1",
+			Receive:  InterfaceCounters{Bytes: 1000, Packets: 10},
+			Transmit: InterfaceCounters{Bytes: 2000, Packets: 20},
+			Speed:    -1, OperState: "down", Carrier: -1, CarrierChanges: 8,
+		},
+		{
+			Name:     "usb0",
+			Receive:  InterfaceCounters{Bytes: 11, Packets: 2, Drops: 1},
+			Transmit: InterfaceCounters{Bytes: 22, Packets: 3, Errors: 4},
+			Speed:    -1, OperState: "up", Carrier: -1, CarrierChanges: -1, FromSysfs: true,
+		},
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("got %+v\nwant %+v", stats, want)
+	}
+}
+
+func TestReadInterfacesIncludes(t *testing.T) {
+	var procNetDev, sysClassNet = fakeNetDirs(t)
+	var tests = []struct {
+		includes []string
+		excludes []string
+		want     []string
+	}{
+		{nil, nil, []string{"eth0", "eth1", "lo", "usb0", "wlan0"}},
+		{[]string{"eth*"}, nil, []string{"eth0", "eth1"}},
+		{[]string{"eth*", "wlan0"}, []string{"eth1"}, []string{"eth0", "wlan0"}},
+		{nil, []string{"*0"}, []string{"eth1", "lo"}},
+	}
+	for _, test := range tests {
+		var n = &NetworkInterfaces{procNetDevFile: procNetDev, sysClassNetDir: sysClassNet, includes: test.includes, excludes: test.excludes}
+		var stats, err = n.ReadInterfaces()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names = []string{}
+		for _, stat := range stats {
+			names = append(names, stat.Name)
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("includes %q excludes %q: got %q, want %q", test.includes, test.excludes, names, test.want)
+		}
+	}
+}
+
+func TestReadInterfacesWithoutProc(t *testing.T) {
+	var _, sysClassNet = fakeNetDirs(t)
+	var n = &NetworkInterfaces{procNetDevFile: filepath.Join(t.TempDir(), "missing"), sysClassNetDir: sysClassNet, includes: []string{"usb0", "eth0"}}
+	var stats, err = n.ReadInterfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || !stats[0].FromSysfs || stats[0].Receive.Bytes != 999999 || stats[1].Receive.Bytes != 11 {
+		t.Errorf("expected both from sysfs, got %+v", stats)
+	}
+
+	n = &NetworkInterfaces{procNetDevFile: "/nonexistent/dev", sysClassNetDir: "/nonexistent/net"}
+	if _, err = n.ReadInterfaces(); err == nil {
+		t.Errorf("expected an error without proc and sysfs")
+	}
+}
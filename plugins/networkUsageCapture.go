@@ -0,0 +1,266 @@
+// passive accounting for networks where iptables can not be touched, like a
+// mirror port of the switch, packets are sniffed on CAPTURE_INTERFACE with an
+// AF_PACKET socket, or replayed from CAPTURE_FILE (.pcap or .pcapng) once at
+// start, and attributed to the devices of INVENTORY_FILE by ip, else by mac,
+// a packet from a device is up and a packet to a device is down, with name
+// resolution other hosts of the local networks are named from their leases or
+// as "unknown:<mac>"
+// the counters start from zero with the process, which the baseline treats
+// like any other counter reset
+
+package plugins
+
+import (
+	"fmt"
+	"garfield/rpi-api-server/utils"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+type packetSource interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+}
+
+type captureBackend struct {
+	iface         string
+	file          string
+	promiscuous   bool
+	inventoryFile string
+	direction     *directionConfig
+	names         *nameResolver
+	logger        *log.Logger
+
+	lock         sync.Mutex
+	byIp         map[string]string
+	byMac        map[string]string
+	usage        map[usageKey]DeviceUsage
+	packets      int
+	unattributed int
+	lastErr      error
+}
+
+func newCaptureBackend(inventoryFile string, direction *directionConfig, names *nameResolver, logger *log.Logger) *captureBackend {
+	var ret = &captureBackend{
+		iface:         utils.GetEnvVarString("CAPTURE_INTERFACE", "eth0"),
+		file:          utils.GetEnvVarString("CAPTURE_FILE", ""),
+		promiscuous:   utils.GetEnvVarBool("CAPTURE_PROMISCUOUS", true),
+		inventoryFile: inventoryFile,
+		direction:     direction,
+		names:         names,
+		logger:        logger,
+		usage:         map[usageKey]DeviceUsage{},
+	}
+	if inventoryFile == "" && names == nil {
+		panic("capture backend needs INVENTORY_FILE or NAME_RESOLUTION to attribute packets")
+	}
+	if err := ret.loadInventory(); err != nil {
+		panic(fmt.Sprintf("failed to load inventory: %s", err))
+	}
+	if ret.file != "" {
+		// replayed synchronously, so the counters are final once started
+		if err := ret.replay(); err != nil {
+			panic(fmt.Sprintf("failed to replay %q: %s", ret.file, err))
+		}
+		return ret
+	}
+	var handle, err = pcapgo.NewEthernetHandle(ret.iface)
+	if err != nil {
+		panic(fmt.Sprintf("failed to capture on %q: %s", ret.iface, err))
+	}
+	if err = handle.SetPromiscuous(ret.promiscuous); err != nil {
+		panic(fmt.Sprintf("failed to set promiscuous mode on %q: %s", ret.iface, err))
+	}
+	go ret.capturing(handle, layers.LayerTypeEthernet)
+	return ret
+}
+
+func (b *captureBackend) Name() string {
+	return usageBackendCapture
+}
+
+func (b *captureBackend) Command() string {
+	if b.file != "" {
+		return fmt.Sprintf("replay of %s", b.file)
+	}
+	return fmt.Sprintf("capture on %s, promiscuous %t", b.iface, b.promiscuous)
+}
+
+// loadInventory is called on every read, so edits apply on the next tick
+func (b *captureBackend) loadInventory() error {
+	if b.inventoryFile == "" {
+		b.lock.Lock()
+		b.byIp, b.byMac = map[string]string{}, map[string]string{}
+		b.lock.Unlock()
+		return nil
+	}
+	var inventory, err = loadInventory(b.inventoryFile)
+	if err != nil {
+		return err
+	}
+	var byIp, byMac = inventoryAddresses(inventory)
+	b.lock.Lock()
+	b.byIp, b.byMac = byIp, byMac
+	b.lock.Unlock()
+	return nil
+}
+
+func (b *captureBackend) ReadUsage() (map[usageKey]DeviceUsage, []byte, []string, error) {
+	var warnings = []string{}
+	if err := b.loadInventory(); err != nil {
+		warnings = append(warnings, fmt.Sprintf("failed to reload inventory, using the last one: %s", err))
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.lastErr != nil {
+		return nil, nil, warnings, b.lastErr
+	}
+	var usage = map[usageKey]DeviceUsage{}
+	for key, value := range b.usage {
+		usage[key] = value
+	}
+	var summary = fmt.Sprintf("%d packets, %d not attributed to any device", b.packets, b.unattributed)
+	return usage, []byte(summary), warnings, nil
+}
+
+func (b *captureBackend) replay() error {
+	var file, err = os.Open(b.file)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var source packetSource
+	var linkType layers.LinkType
+	if strings.HasSuffix(b.file, ".pcapng") {
+		var reader, err = pcapgo.NewNgReader(file, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return err
+		}
+		source, linkType = reader, reader.LinkType()
+	} else {
+		var reader, err = pcapgo.NewReader(file)
+		if err != nil {
+			return err
+		}
+		source, linkType = reader, reader.LinkType()
+	}
+	var firstLayer gopacket.LayerType
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		firstLayer = layers.LayerTypeEthernet
+	case layers.LinkTypeLinuxSLL:
+		firstLayer = layers.LayerTypeLinuxSLL
+	default:
+		return fmt.Errorf("unsupported link type %s", linkType)
+	}
+	b.capturing(source, firstLayer)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.logger.Printf("replayed %d packets, %d not attributed to any device", b.packets, b.unattributed)
+	return b.lastErr
+}
+
+// capturing reads until the source ends, which only a replayed file does
+func (b *captureBackend) capturing(source packetSource, firstLayer gopacket.LayerType) {
+	var ethernet layers.Ethernet
+	var sll layers.LinuxSLL
+	var dot1q layers.Dot1Q
+	var ipv4 layers.IPv4
+	var ipv6 layers.IPv6
+	var parser = gopacket.NewDecodingLayerParser(firstLayer, &ethernet, &sll, &dot1q, &ipv4, &ipv6)
+	parser.IgnoreUnsupported = true
+	var decoded = []gopacket.LayerType{}
+	for {
+		var data, info, err = source.ReadPacketData()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			b.logger.Printf("failed to read packet: %s", err)
+			b.lock.Lock()
+			b.lastErr = err
+			b.lock.Unlock()
+			// the socket does not recover, keep the error for the next reads
+			if b.file != "" {
+				return
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+		var srcMac, dstMac net.HardwareAddr
+		var srcIp, dstIp net.IP
+		var family = familyAny
+		if err = parser.DecodeLayers(data, &decoded); err != nil {
+			continue
+		}
+		for _, layerType := range decoded {
+			switch layerType {
+			case layers.LayerTypeEthernet:
+				srcMac, dstMac = ethernet.SrcMAC, ethernet.DstMAC
+			case layers.LayerTypeLinuxSLL:
+				// only the sending side is known
+				srcMac = sll.Addr
+			case layers.LayerTypeIPv4:
+				srcIp, dstIp, family = ipv4.SrcIP, ipv4.DstIP, familyIpv4
+			case layers.LayerTypeIPv6:
+				srcIp, dstIp, family = ipv6.SrcIP, ipv6.DstIP, familyIpv6
+			}
+		}
+		b.count(info.Length, family, srcMac, dstMac, srcIp, dstIp)
+	}
+}
+
+func (b *captureBackend) count(length int, family string, srcMac net.HardwareAddr, dstMac net.HardwareAddr, srcIp net.IP, dstIp net.IP) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.lastErr = nil
+	b.packets++
+	var from, to = b.attribute(srcMac, srcIp), b.attribute(dstMac, dstIp)
+	if from == "" && to == "" {
+		b.unattributed++
+		return
+	}
+	// traffic between two devices counts for both
+	for _, key := range []usageKey{{Device: from, Direction: directionUp, Family: family}, {Device: to, Direction: directionDown, Family: family}} {
+		if key.Device == "" {
+			continue
+		}
+		var current = b.usage[key]
+		current.Packets++
+		current.Bytes += float64(length)
+		b.usage[key] = current
+	}
+}
+
+// attribute expects the lock to be held, the ip wins as a routed packet
+// carries the mac of the router, which is also why only a local ip is
+// resolved with the mac of the packet
+func (b *captureBackend) attribute(mac net.HardwareAddr, ip net.IP) string {
+	if ip != nil {
+		if name, exists := b.byIp[ip.String()]; exists {
+			return name
+		}
+	}
+	if mac != nil {
+		if name, exists := b.byMac[mac.String()]; exists {
+			return name
+		}
+	}
+	if ip == nil || b.names == nil || !b.direction.isLocal(ip.String()) {
+		return ""
+	}
+	var macString = ""
+	if mac != nil {
+		macString = mac.String()
+	}
+	var name, _ = b.names.nameOf(macString, ip.String())
+	return name
+}
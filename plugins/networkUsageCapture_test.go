@@ -0,0 +1,81 @@
+package plugins
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const captureInventory = `{
+	"tv": {"mac": "aa:bb:cc:00:00:01", "ipv4": ["192.168.1.10"], "ipv6": ["fd00::10"]},
+	"pc": {"mac": "aa:bb:cc:00:00:02", "ipv4": ["192.168.1.20"]}
+}`
+
+func replayFixture(t *testing.T, name string) *captureBackend {
+	var inventoryFile = filepath.Join(t.TempDir(), "inventory.json")
+	if err := ioutil.WriteFile(inventoryFile, []byte(captureInventory), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var b = &captureBackend{
+		file:          "testdata/" + name,
+		inventoryFile: inventoryFile,
+		direction:     newDirectionConfig(),
+		logger:        log.New(ioutil.Discard, "", 0),
+		usage:         map[usageKey]DeviceUsage{},
+	}
+	if err := b.loadInventory(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.replay(); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// capture-ethernet.pcap has plain and vlan tagged frames:
+// tv to the internet, the reply, tv over ipv6 on a vlan, pc over ipv6 from an
+// address not in the inventory, tv to pc on a vlan, a stranger to the
+// internet and an arp request of pc
+func TestReplayEthernet(t *testing.T) {
+	var b = replayFixture(t, "capture-ethernet.pcap")
+	var usage, _, _, err = b.ReadUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want = map[usageKey]DeviceUsage{
+		{Device: "tv", Direction: directionUp, Family: familyIpv4}:   {Packets: 2, Bytes: 180},
+		{Device: "tv", Direction: directionDown, Family: familyIpv4}: {Packets: 1, Bytes: 200},
+		{Device: "tv", Direction: directionUp, Family: familyIpv6}:   {Packets: 1, Bytes: 150},
+		{Device: "pc", Direction: directionUp, Family: familyIpv6}:   {Packets: 1, Bytes: 120},
+		{Device: "pc", Direction: directionDown, Family: familyIpv4}: {Packets: 1, Bytes: 80},
+		{Device: "pc", Direction: directionUp, Family: familyAny}:    {Packets: 1, Bytes: 60},
+	}
+	if !reflect.DeepEqual(usage, want) {
+		t.Errorf("got %v\nwant %v", usage, want)
+	}
+	if b.packets != 7 || b.unattributed != 1 {
+		t.Errorf("got %d packets and %d unattributed, want 7 and 1", b.packets, b.unattributed)
+	}
+}
+
+// capture-sll.pcapng is a capture on "any", only the sender mac is known:
+// tv to the internet, the reply and traffic between two strangers
+func TestReplayLinuxSLL(t *testing.T) {
+	var b = replayFixture(t, "capture-sll.pcapng")
+	var usage, _, _, err = b.ReadUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want = map[usageKey]DeviceUsage{
+		{Device: "tv", Direction: directionUp, Family: familyIpv4}:   {Packets: 1, Bytes: 90},
+		{Device: "tv", Direction: directionDown, Family: familyIpv4}: {Packets: 1, Bytes: 300},
+	}
+	if !reflect.DeepEqual(usage, want) {
+		t.Errorf("got %v\nwant %v", usage, want)
+	}
+	if b.packets != 3 || b.unattributed != 1 {
+		t.Errorf("got %d packets and %d unattributed, want 3 and 1", b.packets, b.unattributed)
+	}
+}
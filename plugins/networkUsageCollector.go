@@ -0,0 +1,84 @@
+// with COLLECTOR_MODE set, network_usage_monitor is read from the backend on
+// every scrape instead of being added to on ticks, the values are the counters
+// as they are, so prometheus sees them without delay and a device removed from
+// the chain drops out, reads are cached for COLLECTOR_CACHE_IN_SECONDS so
+// several scrapers do not run iptables over and over
+// the ticks still run for the baseline, history and quotas
+
+package plugins
+
+import (
+	"garfield/rpi-api-server/utils"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const networkUsageMonitorUpMetricName = "network_usage_monitor_up"
+
+type usageCollector struct {
+	backend  usageBackend
+	cacheFor time.Duration
+	logger   *log.Logger
+	usage    *prometheus.Desc
+	up       *prometheus.Desc
+
+	lock     sync.Mutex
+	cached   map[usageKey]DeviceUsage
+	cachedAt time.Time
+	// failures are cached too, so a broken backend is not hammered
+	cachedErr error
+}
+
+// newUsageCollector returns nil when COLLECTOR_MODE is off
+func newUsageCollector(backend usageBackend, logger *log.Logger) *usageCollector {
+	var enabled = utils.GetEnvVarBool("COLLECTOR_MODE", false)
+	logger.Printf("COLLECTOR_MODE: %t", enabled)
+	if !enabled {
+		return nil
+	}
+	return &usageCollector{
+		backend:  backend,
+		cacheFor: time.Duration(utils.GetEnvVarInt("COLLECTOR_CACHE_IN_SECONDS", 5)) * time.Second,
+		logger:   logger,
+		usage: prometheus.NewDesc(networkUsageMonitorMetricName,
+			"packet and byte counters of devices read from iptables, nftables or captured on scrape",
+			networkUsageMonitorLables, nil),
+		up: prometheus.NewDesc(networkUsageMonitorUpMetricName,
+			"whether the last read of the counters succeeded", nil, nil),
+	}
+}
+
+func (c *usageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.usage
+	ch <- c.up
+}
+
+func (c *usageCollector) read() (map[usageKey]DeviceUsage, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.cachedAt.IsZero() && time.Since(c.cachedAt) < c.cacheFor {
+		return c.cached, c.cachedErr
+	}
+	var usage, _, _, err = c.backend.ReadUsage()
+	if err != nil {
+		c.logger.Printf("failed to read usage on scrape: %s", err)
+	}
+	c.cached, c.cachedAt, c.cachedErr = usage, time.Now(), err
+	return usage, err
+}
+
+func (c *usageCollector) Collect(ch chan<- prometheus.Metric) {
+	var usage, err = c.read()
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 1)
+	for key, value := range usage {
+		ch <- prometheus.MustNewConstMetric(c.usage, prometheus.CounterValue, value.Packets, key.Device, key.Direction, key.Family, metricTypePackets)
+		ch <- prometheus.MustNewConstMetric(c.usage, prometheus.CounterValue, value.Bytes, key.Device, key.Direction, key.Family, metricTypeBytes)
+	}
+}
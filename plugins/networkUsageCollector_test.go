@@ -0,0 +1,83 @@
+package plugins
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUsageCollector(t *testing.T) {
+	for key, value := range map[string]string{"COLLECTOR_MODE": "true", "COLLECTOR_CACHE_IN_SECONDS": "0"} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+	var backend = &fakeBackend{name: usageBackendIptables, usage: map[usageKey]DeviceUsage{
+		{Device: "tv", Direction: directionUp, Family: familyIpv4}:       {Packets: 10, Bytes: 1000},
+		{Device: "phone", Direction: directionTotal, Family: familyIpv6}: {Packets: 3, Bytes: 300},
+	}}
+	var c = newUsageCollector(backend, log.New(ioutil.Discard, "", 0))
+	var registry = prometheus.NewPedanticRegistry()
+	registry.MustRegister(c)
+
+	var want = `
+# HELP network_usage_monitor packet and byte counters of devices read from iptables, nftables or captured on scrape
+# TYPE network_usage_monitor counter
+network_usage_monitor{device_name="phone",direction="total",ip_family="ipv6",metric_type="bytes"} 300
+network_usage_monitor{device_name="phone",direction="total",ip_family="ipv6",metric_type="packets"} 3
+network_usage_monitor{device_name="tv",direction="up",ip_family="ipv4",metric_type="bytes"} 1000
+network_usage_monitor{device_name="tv",direction="up",ip_family="ipv4",metric_type="packets"} 10
+# HELP network_usage_monitor_up whether the last read of the counters succeeded
+# TYPE network_usage_monitor_up gauge
+network_usage_monitor_up 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	// phone is gone from the chain, so its series are too
+	backend.set(map[usageKey]DeviceUsage{
+		{Device: "tv", Direction: directionUp, Family: familyIpv4}: {Packets: 12, Bytes: 1500},
+	}, nil)
+	want = `
+# HELP network_usage_monitor packet and byte counters of devices read from iptables, nftables or captured on scrape
+# TYPE network_usage_monitor counter
+network_usage_monitor{device_name="tv",direction="up",ip_family="ipv4",metric_type="bytes"} 1500
+network_usage_monitor{device_name="tv",direction="up",ip_family="ipv4",metric_type="packets"} 12
+# HELP network_usage_monitor_up whether the last read of the counters succeeded
+# TYPE network_usage_monitor_up gauge
+network_usage_monitor_up 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	backend.set(nil, errors.New("iptables: not found"))
+	want = `
+# HELP network_usage_monitor_up whether the last read of the counters succeeded
+# TYPE network_usage_monitor_up gauge
+network_usage_monitor_up 0
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUsageCollectorCachesReads(t *testing.T) {
+	os.Setenv("COLLECTOR_MODE", "true")
+	defer os.Unsetenv("COLLECTOR_MODE")
+	var backend = &fakeBackend{name: usageBackendIptables, err: errors.New("iptables: not found")}
+	var c = newUsageCollector(backend, log.New(ioutil.Discard, "", 0))
+	// a failure is cached like counters are
+	for i := 0; i < 3; i++ {
+		testutil.CollectAndCount(c)
+	}
+	if backend.reads != 1 {
+		t.Errorf("got %d reads, want 1 within the cache time", backend.reads)
+	}
+}
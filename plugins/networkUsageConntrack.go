@@ -0,0 +1,372 @@
+// which remote hosts a device talks to, with CONNTRACK_SOURCE set to file or
+// command the connection tracking table is read every
+// CONNTRACK_INTERVAL_IN_SECONDS from CONNTRACK_FILE (/proc/net/nf_conntrack)
+// or from `CONNTRACK_COMMAND -L`, a connection belongs to its local side named
+// from INVENTORY_FILE, name resolution or else its ip, and the remote side is
+// the destination
+// only connections in the table are seen, so the bytes are gauges of the
+// active connections and need net.netfilter.nf_conntrack_acct=1, the
+// destinations of all devices are exported for the top
+// CONNTRACK_MAX_DESTINATIONS by bytes, the rest of a device as "other"
+// every destination is its own series, so with up and down there are up to
+// 2 * (CONNTRACK_MAX_DESTINATIONS + devices) series, and a destination
+// entering or leaving the top starts or ends a series, keep the cap low when
+// the history of prometheus matters more than the detail, 0 exports only
+// "other"
+// /flows?device=tv&limit=10 shows the top destinations of the devices
+
+package plugins
+
+import (
+	"fmt"
+	"garfield/rpi-api-server/utils"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const conntrackSourceFile = "file"
+const conntrackSourceCommand = "command"
+
+const destinationLabel = "destination"
+const otherDestination = "other"
+
+// conntrackFlow is a connection of the table, original is the direction of its first packet
+type conntrackFlow struct {
+	Source        string
+	Destination   string
+	OriginalBytes float64
+	ReplyBytes    float64
+	HasCounters   bool
+}
+
+type ConntrackDestination struct {
+	Destination string  `json:"destination"`
+	Connections int     `json:"connections"`
+	UpBytes     float64 `json:"upBytes"`
+	DownBytes   float64 `json:"downBytes"`
+}
+
+type ConntrackDevice struct {
+	Device       string                  `json:"device"`
+	Connections  int                     `json:"connections"`
+	UpBytes      float64                 `json:"upBytes"`
+	DownBytes    float64                 `json:"downBytes"`
+	Destinations []*ConntrackDestination `json:"destinations"`
+}
+
+type usageConntrack struct {
+	source          string
+	file            string
+	command         string
+	interval        time.Duration
+	maxDestinations int
+	inventoryFile   string
+	direction       *directionConfig
+	names           *nameResolver
+	run             commandRunner
+	logger          *log.Logger
+
+	connectionsDesc *prometheus.Desc
+	bytesDesc       *prometheus.Desc
+
+	lock         sync.Mutex
+	readAt       time.Time
+	devices      []*ConntrackDevice
+	flows        int
+	unattributed int
+	lastErr      error
+	warnings     []string
+}
+
+// newUsageConntrack returns nil when CONNTRACK_SOURCE is empty
+func newUsageConntrack(inventoryFile string, direction *directionConfig, names *nameResolver, run commandRunner, logger *log.Logger) *usageConntrack {
+	var source = utils.GetEnvVarString("CONNTRACK_SOURCE", "")
+	logger.Printf("CONNTRACK_SOURCE: %q", source)
+	if source == "" {
+		return nil
+	}
+	if source != conntrackSourceFile && source != conntrackSourceCommand {
+		panic(fmt.Sprintf("invalid conntrack source: %q", source))
+	}
+	return &usageConntrack{
+		source:          source,
+		file:            utils.GetEnvVarString("CONNTRACK_FILE", "/proc/net/nf_conntrack"),
+		command:         utils.GetEnvVarString("CONNTRACK_COMMAND", "conntrack"),
+		interval:        time.Duration(utils.GetEnvVarInt("CONNTRACK_INTERVAL_IN_SECONDS", 30)) * time.Second,
+		maxDestinations: utils.GetEnvVarInt("CONNTRACK_MAX_DESTINATIONS", 100),
+		inventoryFile:   inventoryFile,
+		direction:       direction,
+		names:           names,
+		run:             run,
+		logger:          logger,
+		connectionsDesc: prometheus.NewDesc("network_usage_monitor_connections",
+			"connections of devices in the connection tracking table", []string{deviceNameLabel}, nil),
+		bytesDesc: prometheus.NewDesc("network_usage_monitor_connection_bytes",
+			"bytes of the active connections of devices by destination", []string{deviceNameLabel, destinationLabel, directionLabel}, nil),
+	}
+}
+
+func (c *usageConntrack) Command() string {
+	if c.source == conntrackSourceFile {
+		return fmt.Sprintf("read of %s", c.file)
+	}
+	return c.command + " -L"
+}
+
+func (c *usageConntrack) sampling() {
+	var ticker = time.NewTicker(c.interval)
+	for now := time.Now(); true; now = <-ticker.C {
+		var devices, flows, unattributed, warnings, err = c.read()
+		if err != nil {
+			c.logger.Printf("failed to read connections: %s", err)
+		}
+		c.lock.Lock()
+		c.lastErr = err
+		if err == nil {
+			c.readAt, c.devices, c.flows, c.unattributed, c.warnings = now, devices, flows, unattributed, warnings
+		}
+		c.lock.Unlock()
+	}
+}
+
+func (c *usageConntrack) read() ([]*ConntrackDevice, int, int, []string, error) {
+	var output []byte
+	var err error
+	if c.source == conntrackSourceFile {
+		output, err = ioutil.ReadFile(c.file)
+	} else {
+		var stderr []byte
+		// the summary of the entries is printed to stderr
+		if output, stderr, err = c.run(c.command, "-L"); err != nil {
+			err = fmt.Errorf("%s: %s, stderr: %q", c.Command(), err, stderr)
+		}
+	}
+	if err != nil {
+		return nil, 0, 0, nil, err
+	}
+	var warnings = []string{}
+	var byIp = map[string]string{}
+	if c.inventoryFile != "" {
+		var inventory, err = loadInventory(c.inventoryFile)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("failed to load inventory: %s", err))
+		} else {
+			byIp, _ = inventoryAddresses(inventory)
+		}
+	}
+	var flows = parseConntrack(string(output))
+	var devices = map[string]*ConntrackDevice{}
+	var destinations = map[string]map[string]*ConntrackDestination{}
+	var unattributed = 0
+	var hasCounters = false
+	for _, flow := range flows {
+		hasCounters = hasCounters || flow.HasCounters
+		// the local side owns the connection, the source if both are local
+		var local, remote, up, down = flow.Source, flow.Destination, flow.OriginalBytes, flow.ReplyBytes
+		if !c.direction.isLocal(local) {
+			local, remote, up, down = flow.Destination, flow.Source, flow.ReplyBytes, flow.OriginalBytes
+		}
+		if !c.direction.isLocal(local) {
+			unattributed++
+			continue
+		}
+		var name = c.nameOf(local, byIp)
+		if devices[name] == nil {
+			devices[name] = &ConntrackDevice{Device: name}
+			destinations[name] = map[string]*ConntrackDestination{}
+		}
+		var destination = destinations[name][remote]
+		if destination == nil {
+			destination = &ConntrackDestination{Destination: remote}
+			destinations[name][remote] = destination
+		}
+		devices[name].Connections++
+		devices[name].UpBytes += up
+		devices[name].DownBytes += down
+		destination.Connections++
+		destination.UpBytes += up
+		destination.DownBytes += down
+	}
+	if len(flows) > 0 && !hasCounters {
+		warnings = append(warnings, "connections have no byte counters, set net.netfilter.nf_conntrack_acct=1")
+	}
+	var ret = []*ConntrackDevice{}
+	for name, device := range devices {
+		for _, destination := range destinations[name] {
+			device.Destinations = append(device.Destinations, destination)
+		}
+		sortDestinations(device.Destinations)
+		ret = append(ret, device)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].UpBytes+ret[i].DownBytes != ret[j].UpBytes+ret[j].DownBytes {
+			return ret[i].UpBytes+ret[i].DownBytes > ret[j].UpBytes+ret[j].DownBytes
+		}
+		return ret[i].Device < ret[j].Device
+	})
+	return ret, len(flows), unattributed, warnings, nil
+}
+
+func sortDestinations(destinations []*ConntrackDestination) {
+	sort.Slice(destinations, func(i, j int) bool {
+		var left, right = destinations[i].UpBytes + destinations[i].DownBytes, destinations[j].UpBytes + destinations[j].DownBytes
+		if left != right {
+			return left > right
+		}
+		if destinations[i].Connections != destinations[j].Connections {
+			return destinations[i].Connections > destinations[j].Connections
+		}
+		return destinations[i].Destination < destinations[j].Destination
+	})
+}
+
+// nameOf names a local ip by the inventory, then the resolver, else the ip itself
+func (c *usageConntrack) nameOf(ip string, byIp map[string]string) string {
+	if name, exists := byIp[ip]; exists {
+		return name
+	}
+	if name, found := c.names.nameOf("", ip); found {
+		return name
+	}
+	return ip
+}
+
+// parseConntrack reads lines of /proc/net/nf_conntrack like
+// "ipv4 2 tcp 6 431999 ESTABLISHED src=10.0.0.2 dst=1.1.1.1 sport=1 dport=443 packets=3 bytes=180 src=1.1.1.1 dst=203.0.113.1 ..."
+// and the same without the leading family of `conntrack -L`, the first src,
+// dst and bytes are of the original direction and the second ones of the reply
+func parseConntrack(output string) []conntrackFlow {
+	var ret = []conntrackFlow{}
+	for _, line := range strings.Split(output, "\n") {
+		var flow = conntrackFlow{}
+		var seen = map[string]int{}
+		for _, field := range strings.Fields(line) {
+			var idx = strings.Index(field, "=")
+			if idx < 0 {
+				continue
+			}
+			var key, value = field[:idx], field[idx+1:]
+			seen[key]++
+			var original = seen[key] == 1
+			switch key {
+			case "src":
+				if original {
+					flow.Source = normalizeAddress(value)
+				}
+			case "dst":
+				if original {
+					flow.Destination = normalizeAddress(value)
+				}
+			case "bytes":
+				var bytes, err = strconv.ParseFloat(value, 64)
+				if err != nil {
+					continue
+				}
+				flow.HasCounters = true
+				if original {
+					flow.OriginalBytes = bytes
+				} else {
+					flow.ReplyBytes = bytes
+				}
+			}
+		}
+		if net.ParseIP(flow.Source) == nil || net.ParseIP(flow.Destination) == nil {
+			continue
+		}
+		ret = append(ret, flow)
+	}
+	return ret
+}
+
+func (c *usageConntrack) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.connectionsDesc
+	ch <- c.bytesDesc
+}
+
+// Collect exports the last read, destinations past the cap are summed into
+// "other" of their device, so the series stay within twice the cap plus devices
+func (c *usageConntrack) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	type pair struct {
+		device      string
+		destination *ConntrackDestination
+	}
+	var pairs = []pair{}
+	for _, device := range c.devices {
+		ch <- prometheus.MustNewConstMetric(c.connectionsDesc, prometheus.GaugeValue, float64(device.Connections), device.Device)
+		for _, destination := range device.Destinations {
+			pairs = append(pairs, pair{device.Device, destination})
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return pairs[i].destination.UpBytes+pairs[i].destination.DownBytes > pairs[j].destination.UpBytes+pairs[j].destination.DownBytes
+	})
+	var others = map[string]*ConntrackDestination{}
+	for i, current := range pairs {
+		var destination = current.destination
+		if i >= c.maxDestinations {
+			if others[current.device] == nil {
+				others[current.device] = &ConntrackDestination{Destination: otherDestination}
+			}
+			others[current.device].UpBytes += destination.UpBytes
+			others[current.device].DownBytes += destination.DownBytes
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.bytesDesc, prometheus.GaugeValue, destination.UpBytes, current.device, destination.Destination, directionUp)
+		ch <- prometheus.MustNewConstMetric(c.bytesDesc, prometheus.GaugeValue, destination.DownBytes, current.device, destination.Destination, directionDown)
+	}
+	for device, other := range others {
+		ch <- prometheus.MustNewConstMetric(c.bytesDesc, prometheus.GaugeValue, other.UpBytes, device, otherDestination, directionUp)
+		ch <- prometheus.MustNewConstMetric(c.bytesDesc, prometheus.GaugeValue, other.DownBytes, device, otherDestination, directionDown)
+	}
+}
+
+// HandleFlows serves /flows?device=tv&limit=10, limit caps the destinations of
+// every device and defaults to 10, 0 shows all
+func (c *usageConntrack) HandleFlows(rw http.ResponseWriter, req *http.Request) {
+	var queries = req.URL.Query()
+	var limit = 10
+	if queries.Get("limit") != "" {
+		var err error
+		if limit, err = strconv.Atoi(queries.Get("limit")); err != nil || limit < 0 {
+			writeError(rw, http.StatusBadRequest, fmt.Errorf("invalid limit %q", queries.Get("limit")))
+			return
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var devices = []ConntrackDevice{}
+	for _, device := range c.devices {
+		if queries.Get("device") != "" && device.Device != queries.Get("device") {
+			continue
+		}
+		var current = *device
+		if limit > 0 && len(current.Destinations) > limit {
+			current.Destinations = current.Destinations[:limit]
+		}
+		devices = append(devices, current)
+	}
+	var lastError = ""
+	if c.lastErr != nil {
+		lastError = c.lastErr.Error()
+	}
+	writeJson(rw, http.StatusOK, map[string]interface{}{
+		"command":      c.Command(),
+		"readAt":       c.readAt,
+		"flows":        c.flows,
+		"unattributed": c.unattributed,
+		"warnings":     c.warnings,
+		"lastError":    lastError,
+		"devices":      devices,
+	})
+}
@@ -0,0 +1,82 @@
+package plugins
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseConntrack(t *testing.T) {
+	var want = []conntrackFlow{
+		{Source: "192.168.1.10", Destination: "142.250.74.110", OriginalBytes: 15000, ReplyBytes: 420000, HasCounters: true},
+		{Source: "192.168.1.20", Destination: "1.1.1.1", OriginalBytes: 60, ReplyBytes: 120, HasCounters: true},
+		{Source: "198.51.100.9", Destination: "192.168.1.10", OriginalBytes: 800, ReplyBytes: 900, HasCounters: true},
+		{Source: "fd00::20", Destination: "2606:4700::1111", OriginalBytes: 500, ReplyBytes: 5000, HasCounters: true},
+		{Source: "198.51.100.9", Destination: "203.0.113.5", OriginalBytes: 60, ReplyBytes: 0, HasCounters: true},
+	}
+	// the table file has the family in front, conntrack -L does not
+	for _, fixture := range []string{"nf_conntrack.txt", "conntrack-L.txt"} {
+		if got := parseConntrack(string(readFixture(t, fixture))); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", fixture, got, want)
+		}
+	}
+}
+
+func TestParseConntrackWithoutCounters(t *testing.T) {
+	var output = "tcp 6 100 ESTABLISHED src=192.168.1.10 dst=1.1.1.1 sport=1 dport=443 src=1.1.1.1 dst=192.168.1.10 sport=443 dport=1 mark=0 use=1\n" +
+		"conntrack v1.4.6 (conntrack-tools): 1 flow entries have been shown.\n" +
+		"tcp 6 100 ESTABLISHED src=invalid dst=1.1.1.1 bytes=10\n"
+	var want = []conntrackFlow{{Source: "192.168.1.10", Destination: "1.1.1.1"}}
+	if got := parseConntrack(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestConntrackCollectSumsOtherDestinations(t *testing.T) {
+	var _, ipv4, _ = net.ParseCIDR("192.168.0.0/16")
+	var _, ipv6, _ = net.ParseCIDR("fc00::/7")
+	var c = newUsageConntrack("", &directionConfig{mode: directionModeAddress, localNetworks: []*net.IPNet{ipv4, ipv6}}, nil, nil, log.New(ioutil.Discard, "", 0))
+	if c != nil {
+		t.Fatal("expected no conntrack without CONNTRACK_SOURCE")
+	}
+	for key, value := range map[string]string{"CONNTRACK_SOURCE": conntrackSourceFile, "CONNTRACK_FILE": "testdata/nf_conntrack.txt", "CONNTRACK_MAX_DESTINATIONS": "2"} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+	c = newUsageConntrack("", &directionConfig{mode: directionModeAddress, localNetworks: []*net.IPNet{ipv4, ipv6}}, nil, nil, log.New(ioutil.Discard, "", 0))
+	var devices, flows, unattributed, warnings, err = c.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flows != 5 || unattributed != 1 || len(warnings) != 0 {
+		t.Errorf("got %d flows, %d unattributed and warnings %q, want 5 and 1", flows, unattributed, warnings)
+	}
+	c.devices = devices
+	// the top 2 destinations of all devices are kept, the rest is other of its device
+	var want = `
+# HELP network_usage_monitor_connection_bytes bytes of the active connections of devices by destination
+# TYPE network_usage_monitor_connection_bytes gauge
+network_usage_monitor_connection_bytes{destination="142.250.74.110",device_name="192.168.1.10",direction="down"} 420000
+network_usage_monitor_connection_bytes{destination="142.250.74.110",device_name="192.168.1.10",direction="up"} 15000
+network_usage_monitor_connection_bytes{destination="2606:4700::1111",device_name="fd00::20",direction="down"} 5000
+network_usage_monitor_connection_bytes{destination="2606:4700::1111",device_name="fd00::20",direction="up"} 500
+network_usage_monitor_connection_bytes{destination="other",device_name="192.168.1.10",direction="down"} 800
+network_usage_monitor_connection_bytes{destination="other",device_name="192.168.1.10",direction="up"} 900
+network_usage_monitor_connection_bytes{destination="other",device_name="192.168.1.20",direction="down"} 120
+network_usage_monitor_connection_bytes{destination="other",device_name="192.168.1.20",direction="up"} 60
+# HELP network_usage_monitor_connections connections of devices in the connection tracking table
+# TYPE network_usage_monitor_connections gauge
+network_usage_monitor_connections{device_name="192.168.1.10"} 2
+network_usage_monitor_connections{device_name="192.168.1.20"} 1
+network_usage_monitor_connections{device_name="fd00::20"} 1
+`
+	if err = testutil.CollectAndCompare(c, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
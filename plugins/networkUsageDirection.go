@@ -0,0 +1,162 @@
+// split the usage of a device into upload and download, the direction of a
+// rule is taken from its comment like "device_name: tv dir: up", and with
+// DIRECTION_MODE=address also from its source and destination, a rule from a
+// local network to elsewhere is upload and the opposite is download, rules
+// without a known direction are counted as "total"
+
+package plugins
+
+import (
+	"fmt"
+	"garfield/rpi-api-server/utils"
+	"net"
+	"strings"
+)
+
+const directionUp = "up"
+const directionDown = "down"
+const directionTotal = "total"
+
+const directionModeComment = "comment"
+const directionModeAddress = "address"
+
+// usageKey identifies a counter, a device has either a total or an up and a
+// down counter, of each ip family, see networkUsageFamily.go
+type usageKey struct {
+	Device    string
+	Direction string
+	Family    string
+}
+
+// MarshalText keeps the keys of the baseline file readable, like "tv/up/ipv6",
+// a total counter is only the device name as before directions were supported,
+// and merged families or a baseline from before ipv6 accounting have no family
+func (k usageKey) MarshalText() ([]byte, error) {
+	var text = k.Device
+	if k.Direction != directionTotal && k.Direction != "" {
+		text += "/" + k.Direction
+	}
+	if k.Family != "" {
+		text += "/" + k.Family
+	}
+	return []byte(text), nil
+}
+
+func (k *usageKey) UnmarshalText(text []byte) error {
+	var str = string(text)
+	var idx = strings.LastIndex(str, "/")
+	k.Family = ""
+	if idx >= 0 && isFamily(str[idx+1:]) {
+		str, k.Family = str[:idx], str[idx+1:]
+		idx = strings.LastIndex(str, "/")
+	}
+	if idx >= 0 && (str[idx+1:] == directionUp || str[idx+1:] == directionDown) {
+		k.Device, k.Direction = str[:idx], str[idx+1:]
+		return nil
+	}
+	k.Device, k.Direction = str, directionTotal
+	return nil
+}
+
+func (k usageKey) String() string {
+	var text, _ = k.MarshalText()
+	return string(text)
+}
+
+type directionConfig struct {
+	mode          string
+	commentKey    string
+	localNetworks []*net.IPNet
+}
+
+func newDirectionConfig() *directionConfig {
+	var ret = &directionConfig{
+		mode:       utils.GetEnvVarString("DIRECTION_MODE", directionModeComment),
+		commentKey: utils.GetEnvVarString("DIRECTION_KEY", "dir"),
+	}
+	if ret.mode != directionModeComment && ret.mode != directionModeAddress {
+		panic(fmt.Sprintf("invalid direction mode: %q", ret.mode))
+	}
+	var localNetworks = utils.GetEnvVarString("LOCAL_NETWORKS", "10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7,fe80::/10")
+	for _, cidr := range strings.Split(localNetworks, ",") {
+		var _, network, err = net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			panic(fmt.Sprintf("invalid local network %q: %s", cidr, err))
+		}
+		ret.localNetworks = append(ret.localNetworks, network)
+	}
+	return ret
+}
+
+// directionFromComment accepts "up" and "down" or "upload" and "download"
+func (d *directionConfig) directionFromComment(comment string) (string, bool) {
+	var value, found = deviceNameFromComment(comment, d.commentKey)
+	if !found {
+		return "", false
+	}
+	switch strings.ToLower(value) {
+	case directionUp, "upload":
+		return directionUp, true
+	case directionDown, "download":
+		return directionDown, true
+	}
+	return "", false
+}
+
+// isLocal tells if the whole address or network is inside a local network, so
+// an unrestricted source like 0.0.0.0/0 is not local
+func (d *directionConfig) isLocal(address string) bool {
+	var network = parseAddress(address)
+	if network == nil {
+		return false
+	}
+	var ones, _ = network.Mask.Size()
+	for _, local := range d.localNetworks {
+		var localOnes, _ = local.Mask.Size()
+		if local.Contains(network.IP) && ones >= localOnes {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAddress parses an address or a cidr, an empty one is any address
+func parseAddress(address string) *net.IPNet {
+	if address == "" {
+		return nil
+	}
+	if !strings.Contains(address, "/") {
+		var ip = net.ParseIP(address)
+		if ip == nil {
+			return nil
+		}
+		var bits = 128
+		if ip.To4() != nil {
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	var _, network, err = net.ParseCIDR(address)
+	if err != nil {
+		return nil
+	}
+	return network
+}
+
+// resolve returns the direction of a rule, the comment wins over the addresses
+func (d *directionConfig) resolve(comment string, source string, destination string) string {
+	if direction, found := d.directionFromComment(comment); found {
+		return direction
+	}
+	if d.mode != directionModeAddress {
+		return directionTotal
+	}
+	var fromLocal, toLocal = d.isLocal(source), d.isLocal(destination)
+	switch {
+	case fromLocal && !toLocal:
+		return directionUp
+	case toLocal && !fromLocal:
+		return directionDown
+	}
+	return directionTotal
+}
@@ -0,0 +1,109 @@
+package plugins
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func newTestDirection(mode string) *directionConfig {
+	var ret = &directionConfig{mode: mode, commentKey: "dir"}
+	for _, cidr := range []string{"192.168.0.0/16", "fd00::/8"} {
+		var _, network, _ = net.ParseCIDR(cidr)
+		ret.localNetworks = append(ret.localNetworks, network)
+	}
+	return ret
+}
+
+func TestIsLocal(t *testing.T) {
+	var direction = newTestDirection(directionModeAddress)
+	var tests = []struct {
+		address string
+		local   bool
+	}{
+		{"192.168.1.10", true},
+		{"192.168.1.0/24", true},
+		{"fd00::10", true},
+		{"8.8.8.8", false},
+		{"2606:4700::1111", false},
+		// wider than the local network, so not all of it is local
+		{"192.0.0.0/8", false},
+		{"0.0.0.0/0", false},
+		{"", false},
+		{"invalid", false},
+	}
+	for _, test := range tests {
+		if got := direction.isLocal(test.address); got != test.local {
+			t.Errorf("%q: got %t, want %t", test.address, got, test.local)
+		}
+	}
+}
+
+func TestResolveDirection(t *testing.T) {
+	var tests = []struct {
+		mode        string
+		comment     string
+		source      string
+		destination string
+		want        string
+	}{
+		{directionModeAddress, "device_name: tv", "192.168.1.10", "", directionUp},
+		{directionModeAddress, "device_name: tv", "", "192.168.1.10", directionDown},
+		{directionModeAddress, "device_name: tv", "fd00::10", "2606:4700::1111", directionUp},
+		// local to local and unrestricted rules have no direction
+		{directionModeAddress, "device_name: tv", "192.168.1.10", "192.168.1.20", directionTotal},
+		{directionModeAddress, "device_name: tv", "", "", directionTotal},
+		// the comment wins over the addresses
+		{directionModeAddress, "device_name: tv dir: download", "192.168.1.10", "", directionDown},
+		{directionModeComment, "device_name: tv dir: up", "", "", directionUp},
+		{directionModeComment, "device_name: tv", "192.168.1.10", "", directionTotal},
+		{directionModeComment, "device_name: tv dir: sideways", "", "", directionTotal},
+	}
+	for _, test := range tests {
+		if got := newTestDirection(test.mode).resolve(test.comment, test.source, test.destination); got != test.want {
+			t.Errorf("%s %q from %q to %q: got %s, want %s", test.mode, test.comment, test.source, test.destination, got, test.want)
+		}
+	}
+}
+
+func TestUsageKeyText(t *testing.T) {
+	var tests = []struct {
+		key  usageKey
+		text string
+	}{
+		{usageKey{Device: "tv", Direction: directionTotal}, "tv"},
+		{usageKey{Device: "tv", Direction: directionUp}, "tv/up"},
+		{usageKey{Device: "tv", Direction: directionDown, Family: familyIpv6}, "tv/down/ipv6"},
+		{usageKey{Device: "tv", Direction: directionTotal, Family: familyAny}, "tv/any"},
+		// a slash in a device name stays part of the name
+		{usageKey{Device: "living/tv", Direction: directionUp, Family: familyIpv4}, "living/tv/up/ipv4"},
+	}
+	for _, test := range tests {
+		var text, _ = test.key.MarshalText()
+		if string(text) != test.text {
+			t.Errorf("%+v: got %q, want %q", test.key, text, test.text)
+		}
+		var key = usageKey{}
+		if err := key.UnmarshalText(text); err != nil || key != test.key {
+			t.Errorf("%q: got %+v and error %v, want %+v", text, key, err, test.key)
+		}
+	}
+}
+
+func TestUsageKeyReadsOldFormats(t *testing.T) {
+	// keys of baselines saved before directions and before families
+	var old = `{"tv": {"Packets": 1, "Bytes": 10}, "pc/up": {"Packets": 2, "Bytes": 20}, "pc/down/ipv6": {"Packets": 3, "Bytes": 30}}`
+	var usage = map[usageKey]DeviceUsage{}
+	if err := json.Unmarshal([]byte(old), &usage); err != nil {
+		t.Fatal(err)
+	}
+	var want = map[usageKey]DeviceUsage{
+		{Device: "tv", Direction: directionTotal}:                    {Packets: 1, Bytes: 10},
+		{Device: "pc", Direction: directionUp}:                       {Packets: 2, Bytes: 20},
+		{Device: "pc", Direction: directionDown, Family: familyIpv6}: {Packets: 3, Bytes: 30},
+	}
+	if !reflect.DeepEqual(usage, want) {
+		t.Errorf("got %v, want %v", usage, want)
+	}
+}
@@ -0,0 +1,95 @@
+// ipv6 accounting, with IPV6_ACCOUNTING set the iptables backend also reads
+// the chain with IP6TABLES_COMMAND (or IP6TABLES_SAVE_COMMAND), the nftables
+// backend tells the families apart in an inet table by the ip and ip6 matches
+// of a rule, and captured packets by their ip layer
+// counters are exported with an ip_family label of ipv4, ipv6 or any, any is a
+// rule matching both families or traffic that is not ip, history, quotas and
+// rates merge the families of a device
+
+package plugins
+
+import (
+	"fmt"
+	"strings"
+)
+
+const familyIpv4 = "ipv4"
+const familyIpv6 = "ipv6"
+const familyAny = "any"
+
+func isFamily(value string) bool {
+	return value == familyIpv4 || value == familyIpv6 || value == familyAny
+}
+
+// tableFamily maps the family of an nftables table, inet and others hold both
+func tableFamily(family string) string {
+	switch family {
+	case "ip":
+		return familyIpv4
+	case "ip6":
+		return familyIpv6
+	}
+	return familyAny
+}
+
+// withFamily sets the family of the counters of a backend reading one family
+func withFamily(usage map[usageKey]DeviceUsage, family string) map[usageKey]DeviceUsage {
+	var ret = make(map[usageKey]DeviceUsage, len(usage))
+	for key, value := range usage {
+		key.Family = family
+		ret[key] = value
+	}
+	return ret
+}
+
+// mergeFamilies sums the families of a device and direction
+func mergeFamilies(usage map[usageKey]DeviceUsage) map[usageKey]DeviceUsage {
+	var ret = make(map[usageKey]DeviceUsage, len(usage))
+	for key, value := range usage {
+		key.Family = ""
+		var current = ret[key]
+		current.Packets += value.Packets
+		current.Bytes += value.Bytes
+		ret[key] = current
+	}
+	return ret
+}
+
+// mergedBackend reads several backends as one, a failing one fails the read
+// as missing counters would be taken as new ones on the next read
+type mergedBackend struct {
+	backends []usageBackend
+}
+
+func (b *mergedBackend) Name() string {
+	return b.backends[0].Name()
+}
+
+func (b *mergedBackend) Command() string {
+	var commands = []string{}
+	for _, backend := range b.backends {
+		commands = append(commands, backend.Command())
+	}
+	return strings.Join(commands, "; ")
+}
+
+func (b *mergedBackend) ReadUsage() (map[usageKey]DeviceUsage, []byte, []string, error) {
+	var usage = map[usageKey]DeviceUsage{}
+	var stdout = []byte{}
+	var warnings = []string{}
+	for _, backend := range b.backends {
+		var current, out, currentWarnings, err = backend.ReadUsage()
+		stdout = append(stdout, out...)
+		warnings = append(warnings, currentWarnings...)
+		if err != nil {
+			return nil, stdout, warnings, err
+		}
+		for key, value := range current {
+			if _, exists := usage[key]; exists {
+				return nil, stdout, warnings, fmt.Errorf("counter %q read by more than one backend", key)
+			}
+			usage[key] = value
+		}
+	}
+	return usage, stdout, warnings, nil
+}
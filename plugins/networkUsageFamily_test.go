@@ -0,0 +1,161 @@
+package plugins
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakeBackend returns the counters it is given and counts its reads
+type fakeBackend struct {
+	name     string
+	stdout   string
+	warnings []string
+
+	lock  sync.Mutex
+	usage map[usageKey]DeviceUsage
+	err   error
+	reads int
+}
+
+func (f *fakeBackend) Name() string {
+	return f.name
+}
+
+func (f *fakeBackend) Command() string {
+	return f.name + " -L"
+}
+
+func (f *fakeBackend) ReadUsage() (map[usageKey]DeviceUsage, []byte, []string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.reads++
+	if f.err != nil {
+		return nil, []byte(f.stdout), f.warnings, f.err
+	}
+	var usage = map[usageKey]DeviceUsage{}
+	for key, value := range f.usage {
+		usage[key] = value
+	}
+	return usage, []byte(f.stdout), f.warnings, nil
+}
+
+func (f *fakeBackend) readCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.reads
+}
+
+func (f *fakeBackend) set(usage map[usageKey]DeviceUsage, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.usage, f.err = usage, err
+}
+
+func TestMergedBackend(t *testing.T) {
+	var ipv4 = &fakeBackend{name: usageBackendIptables, stdout: "ipv4\n", warnings: []string{"ipv4 warning"}, usage: map[usageKey]DeviceUsage{
+		{Device: "tv", Direction: directionUp, Family: familyIpv4}: {Packets: 1, Bytes: 100},
+	}}
+	var ipv6 = &fakeBackend{name: usageBackendIptables, stdout: "ipv6\n", usage: map[usageKey]DeviceUsage{
+		{Device: "tv", Direction: directionUp, Family: familyIpv6}: {Packets: 2, Bytes: 200},
+	}}
+	var backend = &mergedBackend{backends: []usageBackend{ipv4, ipv6}}
+	var usage, stdout, warnings, err = backend.ReadUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want = map[usageKey]DeviceUsage{
+		{Device: "tv", Direction: directionUp, Family: familyIpv4}: {Packets: 1, Bytes: 100},
+		{Device: "tv", Direction: directionUp, Family: familyIpv6}: {Packets: 2, Bytes: 200},
+	}
+	if !reflect.DeepEqual(usage, want) || string(stdout) != "ipv4\nipv6\n" || !reflect.DeepEqual(warnings, []string{"ipv4 warning"}) {
+		t.Errorf("got %v, %q and %q, want %v with the output of both", usage, stdout, warnings, want)
+	}
+	if got := backend.Command(); got != "iptables -L; iptables -L" {
+		t.Errorf("got command %q", got)
+	}
+	var merged = mergeFamilies(usage)
+	if !reflect.DeepEqual(merged, map[usageKey]DeviceUsage{{Device: "tv", Direction: directionUp}: {Packets: 3, Bytes: 300}}) {
+		t.Errorf("got %v, want the families summed", merged)
+	}
+
+	// the same counter of two backends would be counted twice
+	ipv6.set(map[usageKey]DeviceUsage{{Device: "tv", Direction: directionUp, Family: familyIpv4}: {Packets: 2, Bytes: 200}}, nil)
+	if usage, _, _, err = backend.ReadUsage(); err == nil || usage != nil {
+		t.Errorf("got %v and error %v, want an error for the duplicate counter", usage, err)
+	}
+	// a failing backend fails the read rather than dropping its counters
+	ipv6.set(nil, errors.New("ip6tables: not found"))
+	if usage, _, _, err = backend.ReadUsage(); err == nil || usage != nil {
+		t.Errorf("got %v and error %v, want the error of ip6tables", usage, err)
+	}
+}
+
+func newTestUsageMonitor(t *testing.T, backend usageBackend) *NetworkUsageMonitor {
+	return &NetworkUsageMonitor{
+		backend:        backend,
+		logger:         log.New(ioutil.Discard, "", 0),
+		baselineFile:   filepath.Join(t.TempDir(), "baseline.json"),
+		lastKnownValue: &map[usageKey]DeviceUsage{},
+	}
+}
+
+func TestLoadBaselineWithoutFamilies(t *testing.T) {
+	// saved before ipv6 accounting, with a total and directions
+	var old = `{"savedAt": "2026-01-01T00:00:00Z", "usage": {"phone": {"Packets": 5, "Bytes": 500}, "tv/up": {"Packets": 10, "Bytes": 1000}, "tv/down": {"Packets": 20, "Bytes": 2000}}}`
+	var backend = &fakeBackend{name: usageBackendIptables}
+	var n = newTestUsageMonitor(t, backend)
+	if err := ioutil.WriteFile(n.baselineFile, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !n.loadBaseline() {
+		t.Fatal("expected the baseline to be loaded")
+	}
+	var want = map[usageKey]DeviceUsage{
+		{Device: "phone", Direction: directionTotal, Family: familyIpv4}: {Packets: 5, Bytes: 500},
+		{Device: "tv", Direction: directionUp, Family: familyIpv4}:       {Packets: 10, Bytes: 1000},
+		{Device: "tv", Direction: directionDown, Family: familyIpv4}:     {Packets: 20, Bytes: 2000},
+	}
+	if !reflect.DeepEqual(*n.lastKnownValue, want) {
+		t.Fatalf("got %v, want %v", *n.lastKnownValue, want)
+	}
+	// the next read continues the counters instead of counting them again
+	var current = map[usageKey]DeviceUsage{
+		{Device: "phone", Direction: directionTotal, Family: familyIpv4}: {Packets: 6, Bytes: 600},
+		{Device: "tv", Direction: directionUp, Family: familyIpv4}:       {Packets: 10, Bytes: 1000},
+		{Device: "tv", Direction: directionDown, Family: familyIpv4}:     {Packets: 25, Bytes: 2500},
+	}
+	var incremental = n.GetIncremental(n.lastKnownValue, &current)
+	var wantIncremental = map[usageKey]DeviceUsage{
+		{Device: "phone", Direction: directionTotal, Family: familyIpv4}: {Packets: 1, Bytes: 100},
+		{Device: "tv", Direction: directionUp, Family: familyIpv4}:       {},
+		{Device: "tv", Direction: directionDown, Family: familyIpv4}:     {Packets: 5, Bytes: 500},
+	}
+	if !reflect.DeepEqual(*incremental, wantIncremental) {
+		t.Errorf("got %v, want %v", *incremental, wantIncremental)
+	}
+
+	// saved again the families stay
+	n.saveBaseline()
+	var reloaded = newTestUsageMonitor(t, backend)
+	reloaded.baselineFile = n.baselineFile
+	if !reloaded.loadBaseline() || !reflect.DeepEqual(*reloaded.lastKnownValue, want) {
+		t.Errorf("got %v, want %v", *reloaded.lastKnownValue, want)
+	}
+}
+
+func TestLoadBaselineWithoutFamiliesStartsOverForNftables(t *testing.T) {
+	// an inet table may have counted both families, so the counters are unknown
+	var old = `{"savedAt": "2026-01-01T00:00:00Z", "usage": {"tv/up": {"Packets": 10, "Bytes": 1000}}}`
+	var n = newTestUsageMonitor(t, &fakeBackend{name: usageBackendNftables})
+	if err := ioutil.WriteFile(n.baselineFile, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n.loadBaseline() {
+		t.Errorf("expected no baseline, got %v", *n.lastKnownValue)
+	}
+}
@@ -0,0 +1,278 @@
+// long term usage history, as prometheus on the pi keeps only weeks, the
+// increments of every tick are added to hourly, daily and monthly buckets in
+// local time and kept in USAGE_HISTORY_FILE, the buckets are pruned after
+// HOURLY_RETENTION_DAYS, DAILY_RETENTION_DAYS and MONTHLY_RETENTION_MONTHS
+// the file is rewritten as a whole, so only when an hour starts or
+// USAGE_HISTORY_SAVE_INTERVAL_IN_SECONDS passed, to spare the sd card
+// /report?from=2026-01-01&to=2026-02-01&group=day&format=csv&device=tv serves
+// them, from and to are dates or RFC3339 times, group is hour, day or month
+
+package plugins
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"garfield/rpi-api-server/utils"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const reportGroupHour = "hour"
+const reportGroupDay = "day"
+const reportGroupMonth = "month"
+
+type usageBucket struct {
+	Start time.Time                `json:"start"`
+	Usage map[usageKey]DeviceUsage `json:"usage"`
+}
+
+type usageHistoryBuckets struct {
+	Hourly  []*usageBucket `json:"hourly"`
+	Daily   []*usageBucket `json:"daily"`
+	Monthly []*usageBucket `json:"monthly"`
+}
+
+type ReportRow struct {
+	Start     time.Time `json:"start"`
+	Device    string    `json:"device"`
+	Direction string    `json:"direction"`
+	Packets   float64   `json:"packets"`
+	Bytes     float64   `json:"bytes"`
+}
+
+type usageHistory struct {
+	filePath        string
+	hourlyRetention time.Duration
+	dailyRetention  time.Duration
+	monthlyMonths   int
+	saveInterval    time.Duration
+	logger          *log.Logger
+
+	lock    sync.Mutex
+	buckets usageHistoryBuckets
+	savedAt time.Time
+}
+
+// newUsageHistory returns nil when USAGE_HISTORY_FILE is empty
+func newUsageHistory(logger *log.Logger) *usageHistory {
+	var filePath = utils.GetEnvVarString("USAGE_HISTORY_FILE", "network_usage_history.json")
+	logger.Printf("USAGE_HISTORY_FILE: %q", filePath)
+	if filePath == "" {
+		return nil
+	}
+	var ret = &usageHistory{
+		filePath:        filePath,
+		hourlyRetention: time.Duration(utils.GetEnvVarInt("HOURLY_RETENTION_DAYS", 14)) * 24 * time.Hour,
+		dailyRetention:  time.Duration(utils.GetEnvVarInt("DAILY_RETENTION_DAYS", 400)) * 24 * time.Hour,
+		monthlyMonths:   utils.GetEnvVarInt("MONTHLY_RETENTION_MONTHS", 60),
+		saveInterval:    time.Duration(utils.GetEnvVarInt("USAGE_HISTORY_SAVE_INTERVAL_IN_SECONDS", 900)) * time.Second,
+		logger:          logger,
+	}
+	logger.Printf("usage history saved every %s and when an hour starts", ret.saveInterval)
+	ret.load()
+	return ret
+}
+
+func (h *usageHistory) load() {
+	var jsonBytes, err = ioutil.ReadFile(h.filePath)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(jsonBytes, &h.buckets)
+	}
+	if err != nil {
+		h.logger.Printf("failed to load usage history from %q: %s", h.filePath, err)
+		h.buckets = usageHistoryBuckets{}
+		return
+	}
+	h.logger.Printf("loaded usage history of %d hours, %d days and %d months",
+		len(h.buckets.Hourly), len(h.buckets.Daily), len(h.buckets.Monthly))
+}
+
+// save expects the lock to be held
+func (h *usageHistory) save(now time.Time) {
+	var jsonBytes, err = json.Marshal(h.buckets)
+	if err == nil {
+		err = utils.WriteFileAtomically(h.filePath, jsonBytes)
+	}
+	if err != nil {
+		h.logger.Printf("failed to save usage history to %q: %s", h.filePath, err)
+		return
+	}
+	h.savedAt = now
+}
+
+func bucketStart(group string, t time.Time) time.Time {
+	switch group {
+	case reportGroupHour:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case reportGroupMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// addTo adds to the bucket starting at start, ticks come in order so it is
+// almost always the last one
+func addTo(buckets []*usageBucket, start time.Time, incremental map[usageKey]DeviceUsage) []*usageBucket {
+	var i = len(buckets)
+	for i > 0 && buckets[i-1].Start.After(start) {
+		i--
+	}
+	var bucket *usageBucket
+	if i > 0 && buckets[i-1].Start.Equal(start) {
+		bucket = buckets[i-1]
+	} else {
+		bucket = &usageBucket{Start: start, Usage: map[usageKey]DeviceUsage{}}
+		buckets = append(buckets, nil)
+		copy(buckets[i+1:], buckets[i:])
+		buckets[i] = bucket
+	}
+	for key, usage := range incremental {
+		if usage.Packets == 0 && usage.Bytes == 0 {
+			continue
+		}
+		var current = bucket.Usage[key]
+		current.Packets += usage.Packets
+		current.Bytes += usage.Bytes
+		bucket.Usage[key] = current
+	}
+	return buckets
+}
+
+func pruneBefore(buckets []*usageBucket, cutoff time.Time) []*usageBucket {
+	var keep = 0
+	for keep < len(buckets) && buckets[keep].Start.Before(cutoff) {
+		keep++
+	}
+	return buckets[keep:]
+}
+
+// add records the increments of a tick, rolled up into every level at once
+func (h *usageHistory) add(incremental map[usageKey]DeviceUsage, now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.buckets.Hourly = addTo(h.buckets.Hourly, bucketStart(reportGroupHour, now), incremental)
+	h.buckets.Daily = addTo(h.buckets.Daily, bucketStart(reportGroupDay, now), incremental)
+	h.buckets.Monthly = addTo(h.buckets.Monthly, bucketStart(reportGroupMonth, now), incremental)
+	h.buckets.Hourly = pruneBefore(h.buckets.Hourly, now.Add(-h.hourlyRetention))
+	h.buckets.Daily = pruneBefore(h.buckets.Daily, now.Add(-h.dailyRetention))
+	h.buckets.Monthly = pruneBefore(h.buckets.Monthly, bucketStart(reportGroupMonth, now).AddDate(0, -h.monthlyMonths, 0))
+	if now.Sub(h.savedAt) >= h.saveInterval || !bucketStart(reportGroupHour, now).Equal(bucketStart(reportGroupHour, h.savedAt)) {
+		h.save(now)
+	}
+}
+
+// report returns the rows of buckets starting in [from, to)
+func (h *usageHistory) report(group string, from time.Time, to time.Time, device string) []ReportRow {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var buckets = h.buckets.Daily
+	switch group {
+	case reportGroupHour:
+		buckets = h.buckets.Hourly
+	case reportGroupMonth:
+		buckets = h.buckets.Monthly
+	}
+	var rows = []ReportRow{}
+	for _, bucket := range buckets {
+		if bucket.Start.Before(from) || !bucket.Start.Before(to) {
+			continue
+		}
+		var start = len(rows)
+		for key, usage := range bucket.Usage {
+			if device != "" && key.Device != device {
+				continue
+			}
+			rows = append(rows, ReportRow{Start: bucket.Start, Device: key.Device, Direction: key.Direction, Packets: usage.Packets, Bytes: usage.Bytes})
+		}
+		var bucketRows = rows[start:]
+		sort.Slice(bucketRows, func(i, j int) bool {
+			if bucketRows[i].Device != bucketRows[j].Device {
+				return bucketRows[i].Device < bucketRows[j].Device
+			}
+			return bucketRows[i].Direction < bucketRows[j].Direction
+		})
+	}
+	return rows
+}
+
+// parseReportTime accepts a date in local time or an RFC3339 time
+func parseReportTime(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func (h *usageHistory) HandleReport(rw http.ResponseWriter, req *http.Request) {
+	var queries = req.URL.Query()
+	var group = queries.Get("group")
+	if group == "" {
+		group = reportGroupDay
+	}
+	var to = time.Now()
+	var from time.Time
+	switch group {
+	case reportGroupHour:
+		from = to.Add(-48 * time.Hour)
+	case reportGroupDay:
+		from = to.AddDate(0, 0, -30)
+	case reportGroupMonth:
+		from = to.AddDate(-1, 0, 0)
+	default:
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("invalid group %q, expecting hour, day or month", group))
+		return
+	}
+	for _, param := range []struct {
+		name  string
+		value *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if queries.Get(param.name) == "" {
+			continue
+		}
+		var parsed, err = parseReportTime(queries.Get(param.name))
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, fmt.Errorf("invalid %s %q, expecting a date or an RFC3339 time", param.name, queries.Get(param.name)))
+			return
+		}
+		*param.value = parsed
+	}
+	if !from.Before(to) {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("from must be before to"))
+		return
+	}
+	// a bucket is reported when it starts in the range, so from is aligned down
+	from = bucketStart(group, from)
+
+	var rows = h.report(group, from, to, queries.Get("device"))
+	switch queries.Get("format") {
+	case "", "json":
+		writeJson(rw, http.StatusOK, map[string]interface{}{"group": group, "from": from, "to": to, "rows": rows})
+	case "csv":
+		rw.Header().Set("Content-Type", "text/csv")
+		rw.WriteHeader(http.StatusOK)
+		var writer = csv.NewWriter(rw)
+		writer.Write([]string{"start", "device_name", "direction", "packets", "bytes"})
+		for _, row := range rows {
+			writer.Write([]string{
+				row.Start.Format(time.RFC3339),
+				row.Device,
+				row.Direction,
+				strconv.FormatFloat(row.Packets, 'f', 0, 64),
+				strconv.FormatFloat(row.Bytes, 'f', 0, 64),
+			})
+		}
+		writer.Flush()
+	default:
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("invalid format %q, expecting json or csv", queries.Get("format")))
+	}
+}
@@ -0,0 +1,51 @@
+package plugins
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUsageHistorySavedOnHourOrInterval(t *testing.T) {
+	var h = &usageHistory{
+		filePath:        filepath.Join(t.TempDir(), "history.json"),
+		hourlyRetention: 24 * time.Hour,
+		dailyRetention:  400 * 24 * time.Hour,
+		monthlyMonths:   60,
+		saveInterval:    15 * time.Minute,
+		logger:          log.New(ioutil.Discard, "", 0),
+	}
+	var tick = map[usageKey]DeviceUsage{{Device: "tv", Direction: directionUp}: {Packets: 1, Bytes: 100}}
+	var start = time.Date(2026, 3, 1, 10, 0, 0, 0, time.Local)
+	var savedBytes = func() float64 {
+		var loaded = &usageHistory{filePath: h.filePath, logger: h.logger}
+		loaded.load()
+		var total float64
+		for _, bucket := range loaded.buckets.Hourly {
+			for _, usage := range bucket.Usage {
+				total += usage.Bytes
+			}
+		}
+		return total
+	}
+	var steps = []struct {
+		at    time.Duration
+		saved float64
+	}{
+		{0, 100},
+		{5 * time.Minute, 100},
+		{10 * time.Minute, 100},
+		{15 * time.Minute, 400},
+		{20 * time.Minute, 400},
+		// a new hour saves before the interval passed
+		{60 * time.Minute, 600},
+	}
+	for _, step := range steps {
+		h.add(tick, start.Add(step.at))
+		if got := savedBytes(); got != step.saved {
+			t.Errorf("after the tick at %s: got %.0f saved bytes, want %.0f", step.at, got, step.saved)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// parse packet and byte counters of iptables rules in go, either from
+// `iptables -nxvL CHAIN` or from `iptables-save -c`, the device name is taken
+// from the comment match like "device_name: some-device", or from the addresses
+// with name resolution, the direction from the comment or the addresses
+
+package plugins
+
+import (
+	"bytes"
+	"fmt"
+	"garfield/rpi-api-server/utils"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const iptablesModeList = "list"
+const iptablesModeSave = "save"
+
+var iptablesListCommentPattern = regexp.MustCompile(`/\* (.*?) \*/`)
+var iptablesSaveCounterPattern = regexp.MustCompile(`^\[(\d+):(\d+)\]\s+(.*)$`)
+
+type iptablesBackend struct {
+	family      string
+	command     string
+	saveCommand string
+	mode        string
+	chainName   string
+	commentKey  string
+	direction   *directionConfig
+	names       *nameResolver
+	run         commandRunner
+}
+
+// newIptablesBackend reads ip6tables for familyIpv6 and iptables otherwise
+func newIptablesBackend(family string, chainName string, commentKey string, direction *directionConfig, names *nameResolver, run commandRunner) *iptablesBackend {
+	var ret = &iptablesBackend{
+		family:      family,
+		command:     utils.GetEnvVarString("IPTABLES_COMMAND", "iptables"),
+		saveCommand: utils.GetEnvVarString("IPTABLES_SAVE_COMMAND", "iptables-save"),
+		mode:        utils.GetEnvVarString("IPTABLES_MODE", iptablesModeList),
+		chainName:   chainName,
+		commentKey:  commentKey,
+		direction:   direction,
+		names:       names,
+		run:         run,
+	}
+	if family == familyIpv6 {
+		ret.command = utils.GetEnvVarString("IP6TABLES_COMMAND", "ip6tables")
+		ret.saveCommand = utils.GetEnvVarString("IP6TABLES_SAVE_COMMAND", "ip6tables-save")
+	}
+	if ret.mode != iptablesModeList && ret.mode != iptablesModeSave {
+		panic(fmt.Sprintf("invalid iptables mode: %q", ret.mode))
+	}
+	return ret
+}
+
+func (b *iptablesBackend) Name() string {
+	return usageBackendIptables
+}
+
+func (b *iptablesBackend) Command() string {
+	var name, args = b.commandArgs()
+	return strings.Join(append([]string{name}, args...), " ")
+}
+
+func (b *iptablesBackend) commandArgs() (string, []string) {
+	if b.mode == iptablesModeSave {
+		return b.saveCommand, []string{"-c", "-t", "filter"}
+	}
+	return b.command, []string{"-nxvL", b.chainName}
+}
+
+func (b *iptablesBackend) ReadUsage() (map[usageKey]DeviceUsage, []byte, []string, error) {
+	var name, args = b.commandArgs()
+	var stdout, stderr, err = b.run(name, args...)
+	if err != nil {
+		return nil, stdout, nil, fmt.Errorf("%s: %s, stderr: %q", b.Command(), err, stderr)
+	}
+	var usage map[usageKey]DeviceUsage
+	var warnings []string
+	if b.mode == iptablesModeSave {
+		usage, warnings = parseIptablesSave(stdout, b.chainName, b.commentKey, b.direction, b.names)
+	} else {
+		usage, warnings = parseIptablesList(stdout, b.commentKey, b.direction, b.names)
+	}
+	// iptables prints warnings like the legacy tables being present to stderr
+	if len(stderr) > 0 {
+		warnings = append(warnings, fmt.Sprintf("stderr: %q", stderr))
+	}
+	return withFamily(usage, b.family), stdout, warnings, nil
+}
+
+// commandRunner runs a command without a shell, injectable so parsing and rule
+// management can be exercised without root
+type commandRunner func(name string, args ...string) (stdout []byte, stderr []byte, err error)
+
+func runCommand(name string, args ...string) ([]byte, []byte, error) {
+	var cmd = exec.Command(name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	var err = cmd.Run()
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// deviceNameFromComment finds "key: name" in the comment, the name ends at the next space
+func deviceNameFromComment(comment string, commentKey string) (string, bool) {
+	var idx = strings.Index(comment, commentKey+":")
+	if idx < 0 {
+		return "", false
+	}
+	var fields = strings.Fields(comment[idx+len(commentKey)+1:])
+	if len(fields) == 0 {
+		return "", false
+	}
+	return fields[0], true
+}
+
+// parseIptablesList parses `iptables -nxvL CHAIN`, rules of the same device and direction are summed
+func parseIptablesList(output []byte, commentKey string, direction *directionConfig, names *nameResolver) (map[usageKey]DeviceUsage, []string) {
+	var usage = map[usageKey]DeviceUsage{}
+	var warnings = []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		var fields = strings.Fields(line)
+		// skip the chain and column headers
+		if len(fields) < 2 || fields[0] == "Chain" || fields[0] == "pkts" {
+			continue
+		}
+		var comment = ""
+		if match := iptablesListCommentPattern.FindStringSubmatch(line); match != nil {
+			comment = match[1]
+		}
+		// the target column may be empty, so source and destination are the first two addresses
+		var addresses = []string{}
+		for _, field := range fields[2:] {
+			if strings.HasPrefix(field, "/*") || len(addresses) == 2 {
+				break
+			}
+			if parseAddress(field) != nil {
+				addresses = append(addresses, field)
+			}
+		}
+		var source, destination = "", ""
+		if len(addresses) == 2 {
+			source, destination = addresses[0], addresses[1]
+		}
+		var deviceName, found = ruleDeviceName(comment, commentKey, names, direction, source, destination)
+		if !found {
+			continue
+		}
+		var packetCount, packetErr = strconv.ParseFloat(fields[0], 64)
+		var byteCount, byteErr = strconv.ParseFloat(fields[1], 64)
+		if packetErr != nil || byteErr != nil {
+			warnings = append(warnings, fmt.Sprintf("invalid counters: %q", line))
+			continue
+		}
+		var key = usageKey{Device: deviceName, Direction: direction.resolve(comment, source, destination)}
+		var current = usage[key]
+		current.Packets += packetCount
+		current.Bytes += byteCount
+		usage[key] = current
+	}
+	return usage, warnings
+}
+
+// parseIptablesSave parses `iptables-save -c`, only rules appended to the chain are used
+func parseIptablesSave(output []byte, chainName string, commentKey string, direction *directionConfig, names *nameResolver) (map[usageKey]DeviceUsage, []string) {
+	var usage = map[usageKey]DeviceUsage{}
+	var warnings = []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		var match = iptablesSaveCounterPattern.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		var args = splitArgs(match[3])
+		if len(args) < 2 || args[0] != "-A" || args[1] != chainName {
+			continue
+		}
+		var comment, source, destination = "", "", ""
+		for i := 0; i+1 < len(args); i++ {
+			switch args[i] {
+			case "--comment":
+				comment = args[i+1]
+			case "-s":
+				source = args[i+1]
+			case "-d":
+				destination = args[i+1]
+			}
+		}
+		var deviceName, found = ruleDeviceName(comment, commentKey, names, direction, source, destination)
+		if !found {
+			continue
+		}
+		var packetCount, packetErr = strconv.ParseFloat(match[1], 64)
+		var byteCount, byteErr = strconv.ParseFloat(match[2], 64)
+		if packetErr != nil || byteErr != nil {
+			warnings = append(warnings, fmt.Sprintf("invalid counters: %q", line))
+			continue
+		}
+		var key = usageKey{Device: deviceName, Direction: direction.resolve(comment, source, destination)}
+		var current = usage[key]
+		current.Packets += packetCount
+		current.Bytes += byteCount
+		usage[key] = current
+	}
+	return usage, warnings
+}
+
+// splitArgs splits like a shell would for iptables-save output, honoring double
+// quotes and backslash escapes
+func splitArgs(line string) []string {
+	var ret = []string{}
+	var current strings.Builder
+	var inQuotes, escaped, hasArg = false, false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			inQuotes = !inQuotes
+			hasArg = true
+		case (r == ' ' || r == '\t') && !inQuotes:
+			if hasArg || current.Len() > 0 {
+				ret = append(ret, current.String())
+				current.Reset()
+				hasArg = false
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if hasArg || current.Len() > 0 {
+		ret = append(ret, current.String())
+	}
+	return ret
+}
@@ -0,0 +1,69 @@
+package plugins
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// the fixtures hold the same rules in both formats, one per direction of tv,
+// two rules of pc with an in and an out interface and no direction, and a
+// rule without a comment that is not counted
+var iptablesFixtureUsage = map[usageKey]DeviceUsage{
+	{Device: "tv", Direction: directionUp}:    {Packets: 1520, Bytes: 204800},
+	{Device: "tv", Direction: directionDown}:  {Packets: 3100, Bytes: 4096000},
+	{Device: "pc", Direction: directionTotal}: {Packets: 20, Bytes: 1600},
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	var content, err = ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestParseIptablesList(t *testing.T) {
+	var usage, warnings = parseIptablesList(readFixture(t, "iptables-list.txt"), "device_name", newDirectionConfig(), nil)
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %q", warnings)
+	}
+	if !reflect.DeepEqual(usage, iptablesFixtureUsage) {
+		t.Errorf("got %v, want %v", usage, iptablesFixtureUsage)
+	}
+}
+
+func TestParseIptablesSave(t *testing.T) {
+	var usage, warnings = parseIptablesSave(readFixture(t, "iptables-save.txt"), "NETWORK-FILTER", "device_name", newDirectionConfig(), nil)
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %q", warnings)
+	}
+	if !reflect.DeepEqual(usage, iptablesFixtureUsage) {
+		t.Errorf("got %v, want %v", usage, iptablesFixtureUsage)
+	}
+}
+
+func TestParseIptablesListInvalidCounters(t *testing.T) {
+	var output = []byte("    12x      960  all  --  *  *  0.0.0.0/0  0.0.0.0/0  /* device_name: pc */\n")
+	var usage, warnings = parseIptablesList(output, "device_name", newDirectionConfig(), nil)
+	if len(usage) != 0 || len(warnings) != 1 {
+		t.Errorf("got usage %v and warnings %q, want one warning", usage, warnings)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	var tests = []struct {
+		line string
+		want []string
+	}{
+		{`-A CHAIN -j RETURN`, []string{"-A", "CHAIN", "-j", "RETURN"}},
+		{`--comment "device_name: tv dir: up"`, []string{"--comment", "device_name: tv dir: up"}},
+		{`--comment "say \"hi\""  -j  X`, []string{"--comment", `say "hi"`, "-j", "X"}},
+		{`--comment ""`, []string{"--comment", ""}},
+	}
+	for _, test := range tests {
+		if got := splitArgs(test.line); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitArgs(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
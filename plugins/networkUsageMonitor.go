@@ -1,18 +1,32 @@
 // list iptables rules and extract packet and byte usage of devices
 // iptalbes rules should have comment like "device_name: some-device"
+// counters are read by a backend chosen with USAGE_BACKEND, iptables (default),
+// nftables or capture, see networkUsageCapture.go
+// a device may have separate up and down rules, see networkUsageDirection.go
+// the rules can be managed from a device inventory, see networkUsageRules.go
+// live rates are sampled apart from the ticks, see networkUsageRates.go
+// devices can have data quotas, see networkUsageQuotas.go
+// devices can be named from dhcp leases and arp, see networkUsageNames.go
+// usage is kept for a long time in hourly to monthly buckets, see networkUsageHistory.go
+// ipv6 is counted too and labelled by ip family, see networkUsageFamily.go
+// the remote hosts of devices can be read from conntrack, see networkUsageConntrack.go
+// the counters can be read on scrape instead of on ticks, see networkUsageCollector.go
+// the status page shows the state of the last tick, POST /read reads the backend afresh
 
 package plugins
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"garfield/rpi-api-server/utils"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"os/exec"
-	"strconv"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -22,13 +36,35 @@ import (
 type NetworkUsageMonitor struct {
 	chainName                string
 	commentKey               string
+	backend                  usageBackend
+	direction                *directionConfig
+	names                    *nameResolver
+	inventoryFile            string
+	ruleManagers             []*ruleManager
+	lastPlan                 []string
+	lastReconcileError       error
+	rates                    *usageRates
+	conntrack                *usageConntrack
+	quotas                   *usageQuotas
+	history                  *usageHistory
+	runCommand               commandRunner
 	command                  string
 	counterVec               *prometheus.CounterVec
-	lastKnownValue           *map[string]DeviceUsage
-	lastStdOut               string
+	collector                *usageCollector
+	lastKnownValue           *map[usageKey]DeviceUsage
+	baselineFile             string
+	hasBaseline              bool
+	resetCounterVec          *prometheus.CounterVec
 	logger                   *log.Logger
 	refreshIntervalInSeconds int
 	ticker                   *time.Ticker
+
+	// guards the state written by the ticks and read by the pages
+	lock            sync.Mutex
+	lastTickAt      time.Time
+	lastReadError   error
+	lastWarnings    []string
+	lastIncremental map[usageKey]DeviceUsage
 }
 
 type DeviceUsage struct {
@@ -37,145 +73,401 @@ type DeviceUsage struct {
 }
 
 const networkUsageMonitorMetricName = "network_usage_monitor"
+const networkUsageMonitorResetsMetricName = "network_usage_monitor_resets_total"
 const deviceNameLabel = "device_name"
 const metricTypeLabel = "metric_type"
+const ipFamilyLabel = "ip_family"
+const directionLabel = "direction"
 const metricTypePackets = "packets"
 const metricTypeBytes = "bytes"
 
-var networkUsageMonitorLables = []string{deviceNameLabel, metricTypeLabel}
+var networkUsageMonitorLables = []string{deviceNameLabel, directionLabel, ipFamilyLabel, metricTypeLabel}
+
+const usageBackendIptables = "iptables"
+const usageBackendNftables = "nftables"
+const usageBackendCapture = "capture"
+
+// usageBackend reads the current counters of every device
+type usageBackend interface {
+	Name() string
+	// Command describes what is run, for logging and the debug page
+	Command() string
+	// ReadUsage returns the usage per device, the raw output and parse warnings
+	ReadUsage() (map[usageKey]DeviceUsage, []byte, []string, error)
+}
 
 func (n *NetworkUsageMonitor) Start() {
 	n.logger = utils.GetLogger("NetworkUsageMonitor")
 	n.chainName = utils.GetEnvVarString("CHAIN_NAME", "NETWORK-FILTER")
 	n.commentKey = utils.GetEnvVarString("COMMENT_KEY", "device_name")
-	n.command = utils.GetEnvVarString("COMMAND", fmt.Sprintf("iptables -nxvL %s | grep %s | tr -s ' ' | cut -d ' ' -f 2,3,13", n.chainName, n.commentKey))
+	if n.runCommand == nil {
+		n.runCommand = runCommand
+	}
+	n.direction = newDirectionConfig()
+	n.names = newNameResolver(n.logger)
+	n.inventoryFile = utils.GetEnvVarString("INVENTORY_FILE", "")
+	n.logger.Printf("INVENTORY_FILE: %q", n.inventoryFile)
+	// COMMAND used to be a shell pipeline, the backends run their commands themselves now
+	if command := utils.GetEnvVarString("COMMAND", ""); command != "" {
+		n.logger.Printf("COMMAND is deprecated and ignored, set USAGE_BACKEND, IPTABLES_COMMAND or IPTABLES_SAVE_COMMAND instead of %q", command)
+	}
+	var backendName = utils.GetEnvVarString("USAGE_BACKEND", usageBackendIptables)
+	n.logger.Printf("USAGE_BACKEND: %q", backendName)
+	switch backendName {
+	case usageBackendIptables:
+		n.backend = newIptablesBackend(familyIpv4, n.chainName, n.commentKey, n.direction, n.names, n.runCommand)
+		var ipv6 = utils.GetEnvVarBool("IPV6_ACCOUNTING", false)
+		n.logger.Printf("IPV6_ACCOUNTING: %t", ipv6)
+		if ipv6 {
+			n.backend = &mergedBackend{backends: []usageBackend{
+				n.backend,
+				newIptablesBackend(familyIpv6, n.chainName, n.commentKey, n.direction, n.names, n.runCommand),
+			}}
+		}
+		if n.inventoryFile != "" {
+			n.ruleManagers = newRuleManagers(n.chainName, n.commentKey, n.direction.commentKey, ipv6, n.runCommand, n.logger)
+			n.logger.Printf("rules are managed, dry run %t", n.ruleManagers[0].dryRun)
+		}
+	case usageBackendNftables:
+		if n.inventoryFile != "" {
+			panic("managed rules need the iptables backend")
+		}
+		n.backend = newNftablesBackend(n.chainName, n.commentKey, n.direction, n.names, n.runCommand)
+	case usageBackendCapture:
+		// the inventory attributes packets instead of managing rules
+		n.backend = newCaptureBackend(n.inventoryFile, n.direction, n.names, n.logger)
+	default:
+		panic(fmt.Sprintf("invalid usage backend: %q", backendName))
+	}
+	n.command = n.backend.Command()
 	n.refreshIntervalInSeconds = utils.GetEnvVarInt("RefreshIntervalInSeconds", 300)
 	n.logger.Printf("CHAIN_NAME: %q", n.chainName)
 	n.logger.Printf("COMMENT_KEY: %q", n.commentKey)
-	n.logger.Printf("COMMAND: %q", n.command)
+	n.logger.Printf("DIRECTION_MODE: %q, DIRECTION_KEY: %q", n.direction.mode, n.direction.commentKey)
+	n.logger.Printf("backend command: %q", n.command)
 	n.logger.Printf("refresh interval is %d seconds", n.refreshIntervalInSeconds)
 
-	n.lastKnownValue = &map[string]DeviceUsage{}
+	n.baselineFile = utils.GetEnvVarString("BASELINE_FILE", "network_usage_baseline.json")
+	n.logger.Printf("BASELINE_FILE: %q", n.baselineFile)
+	n.lastKnownValue = &map[usageKey]DeviceUsage{}
+	if backendName == usageBackendCapture {
+		// the counters start from zero with the process, so all of them are new
+		n.hasBaseline = true
+	} else {
+		n.hasBaseline = n.loadBaseline()
+	}
+
+	n.collector = newUsageCollector(n.backend, n.logger)
+	if n.collector != nil {
+		prometheus.MustRegister(n.collector)
+	} else {
+		n.counterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: networkUsageMonitorMetricName,
+			Help: "extract packet and byte usage of devices from iptalbes or nftables rules",
+		}, networkUsageMonitorLables)
+	}
+	n.resetCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: networkUsageMonitorResetsMetricName,
+		Help: "number of detected counter resets of devices, like a flushed chain or a reboot",
+	}, []string{deviceNameLabel, directionLabel, ipFamilyLabel})
 
-	n.counterVec = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: networkUsageMonitorMetricName,
-		Help: "extract packet and byte usage of devices from iptalbes rules",
-	}, networkUsageMonitorLables)
+	n.history = newUsageHistory(n.logger)
+	n.quotas = newUsageQuotas(n.inventoryFile, n.runCommand, n.logger)
+	n.rates = newUsageRates(n.backend, n.logger)
+	if n.rates != nil {
+		go n.rates.sampling()
+	}
+	n.conntrack = newUsageConntrack(n.inventoryFile, n.direction, n.names, n.runCommand, n.logger)
+	if n.conntrack != nil {
+		prometheus.MustRegister(n.conntrack)
+		go n.conntrack.sampling()
+	}
 
 	n.ticker = time.NewTicker(time.Duration(n.refreshIntervalInSeconds) * time.Second)
 	go n.ticking()
 }
 
 func (n *NetworkUsageMonitor) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "" || req.URL.Path == "/":
+		n.HandleDebugPage(rw, req)
+	case req.URL.Path == "/read":
+		n.HandleRead(rw, req)
+	case req.URL.Path == "/top" && n.rates != nil:
+		n.rates.HandleTop(rw, req)
+	case req.URL.Path == "/flows" && n.conntrack != nil:
+		n.conntrack.HandleFlows(rw, req)
+	case req.URL.Path == "/quotas" && n.quotas != nil:
+		n.quotas.HandleQuotas(rw, req)
+	case req.URL.Path == "/report" && n.history != nil:
+		n.history.HandleReport(rw, req)
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+		io.WriteString(rw, fmt.Sprintf("not found: %s %s\n", req.Method, req.URL.Path))
+	}
+}
+
+// HandleDebugPage shows the state of the last tick, taken under the lock so
+// a tick running meanwhile is either all in or all out
+func (n *NetworkUsageMonitor) HandleDebugPage(rw http.ResponseWriter, req *http.Request) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
 	rw.WriteHeader(http.StatusOK)
+	io.WriteString(rw, fmt.Sprintf("backend: %s\n", n.backend.Name()))
 	io.WriteString(rw, fmt.Sprintf("command is : %q\n", n.command))
-	var lastKnownValueJson, err = json.Marshal(n.lastKnownValue)
-	if err != nil {
-		io.WriteString(rw, fmt.Sprintf(`marshal error: %s`, err.Error()))
+	if n.ruleManagers != nil {
+		io.WriteString(rw, fmt.Sprintf("rules managed from %q, dry run %t, last reconcile error: %v\n", n.inventoryFile, n.ruleManagers[0].dryRun, n.lastReconcileError))
+		io.WriteString(rw, fmt.Sprintf("last planned commands:\n%s\n", strings.Join(n.lastPlan, "\n")))
+	}
+	if n.lastTickAt.IsZero() {
+		io.WriteString(rw, "last tick: none yet\n")
+	} else {
+		io.WriteString(rw, fmt.Sprintf("last tick: %s, every %d seconds\n", n.lastTickAt.Format(time.RFC3339), n.refreshIntervalInSeconds))
 	}
-	io.WriteString(rw, fmt.Sprintf("last known: %s\n", lastKnownValueJson))
+	io.WriteString(rw, fmt.Sprintf("last read error: %v\n", n.lastReadError))
+	io.WriteString(rw, fmt.Sprintf("parse warnings: %q\n", n.lastWarnings))
+	if n.names != nil {
+		io.WriteString(rw, fmt.Sprintf("name resolution errors: %q\n", n.names.errors()))
+	}
+	io.WriteString(rw, "\ncounters of the last tick:\n")
+	writeUsage(rw, *n.lastKnownValue)
+	io.WriteString(rw, "\nincrements of the last tick:\n")
+	writeUsage(rw, n.lastIncremental)
+	io.WriteString(rw, "\nPOST /read to read the counters now\n")
+}
 
-	var usage = n.GetCurrentUsage()
-	usageJson, err := json.Marshal(usage)
-	if err != nil {
-		io.WriteString(rw, fmt.Sprintf(`marshal error: %s`, err.Error()))
+// HandleRead reads the backend on request, showing its output and the
+// increments since the last tick, nothing is kept
+func (n *NetworkUsageMonitor) HandleRead(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(rw, "a fresh read runs the backend, POST to confirm\n")
+		return
+	}
+	var usage, stdout, warnings, err = n.GetCurrentUsage()
+	rw.WriteHeader(http.StatusOK)
+	io.WriteString(rw, fmt.Sprintf("command is : %q\n", n.command))
+	io.WriteString(rw, fmt.Sprintf("read error: %v\n", err))
+	io.WriteString(rw, fmt.Sprintf("parse warnings: %q\n", warnings))
+	io.WriteString(rw, fmt.Sprintf("std out:\n%s\n", stdout))
+	if usage == nil {
+		return
 	}
-	io.WriteString(rw, fmt.Sprintf("std out: %s\n", n.lastStdOut))
-	io.WriteString(rw, fmt.Sprintf("current usage: %s\n", usageJson))
+	io.WriteString(rw, "\ncounters:\n")
+	writeUsage(rw, *usage)
+	n.lock.Lock()
+	var incremental = n.GetIncremental(n.lastKnownValue, usage)
+	n.lock.Unlock()
+	io.WriteString(rw, "\nincrements since the last tick:\n")
+	writeUsage(rw, *incremental)
+}
 
-	var diff = n.GetIncremental(n.lastKnownValue, usage)
-	diffJson, err := json.Marshal(diff)
-	if err != nil {
-		io.WriteString(rw, fmt.Sprintf(`marshal error: %s`, err.Error()))
+// writeUsage lists the devices with their totals and then every counter
+func writeUsage(rw http.ResponseWriter, usage map[usageKey]DeviceUsage) {
+	var byDevice = map[string][]usageKey{}
+	for key := range usage {
+		byDevice[key.Device] = append(byDevice[key.Device], key)
+	}
+	var devices = make([]string, 0, len(byDevice))
+	for device := range byDevice {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	for _, device := range devices {
+		var keys = byDevice[device]
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+		var total = DeviceUsage{}
+		for _, key := range keys {
+			total.Packets += usage[key].Packets
+			total.Bytes += usage[key].Bytes
+		}
+		io.WriteString(rw, fmt.Sprintf("  %s: %.0f packets, %s\n", device, total.Packets, formatBytes(total.Bytes)))
+		for _, key := range keys {
+			var counter = key.Direction
+			if key.Family != "" {
+				counter += " " + key.Family
+			}
+			io.WriteString(rw, fmt.Sprintf("    %s: %.0f packets, %.0f bytes\n", counter, usage[key].Packets, usage[key].Bytes))
+		}
 	}
-	io.WriteString(rw, fmt.Sprintf("incremental usage: %s\n", diffJson))
 }
 
 func (n *NetworkUsageMonitor) ticking() {
-	var labels = map[string]string{deviceNameLabel: "", metricTypeLabel: ""}
+	var labels = map[string]string{deviceNameLabel: "", directionLabel: "", ipFamilyLabel: "", metricTypeLabel: ""}
 	var lastTick = time.Now()
 	for ; true; lastTick = <-n.ticker.C {
 		n.logger.Printf("tick on %s started", lastTick)
+		if n.ruleManagers != nil {
+			n.reconcileRules()
+		}
 		n.logger.Printf("retriving current usage")
-		var currentUsage = n.GetCurrentUsage()
+		var currentUsage, _, warnings, err = n.GetCurrentUsage()
+		for _, warning := range warnings {
+			n.logger.Printf("%s", warning)
+		}
+		n.lock.Lock()
+		n.lastReadError, n.lastWarnings = err, warnings
+		if currentUsage == nil {
+			n.lock.Unlock()
+			n.logger.Printf("tick on %s skipped, failed to retrieve current usage", lastTick)
+			continue
+		}
+		if !n.hasBaseline {
+			// without a baseline the full counters would be added again, start from here instead
+			n.logger.Printf("no baseline yet, saving current usage as baseline")
+			n.lastKnownValue = currentUsage
+			n.hasBaseline = true
+		}
+		for key, current := range *currentUsage {
+			if last, ok := (*n.lastKnownValue)[key]; ok && isCounterReset(last, current) {
+				n.resetCounterVec.With(map[string]string{deviceNameLabel: key.Device, directionLabel: key.Direction, ipFamilyLabel: key.Family}).Inc()
+			}
+		}
 		n.logger.Printf("calculating incremental")
 		var incremental = n.GetIncremental(n.lastKnownValue, currentUsage)
 		n.logger.Printf("saving current usage as last known")
 		n.lastKnownValue = currentUsage
+		n.lastIncremental, n.lastTickAt = *incremental, lastTick
+		n.saveBaseline()
+		n.lock.Unlock()
+		if n.history != nil {
+			n.history.add(mergeFamilies(*incremental), lastTick)
+		}
+		if n.quotas != nil {
+			n.quotas.account(*incremental, lastTick)
+		}
 
-		for name := range *incremental {
-			labels[deviceNameLabel] = name
-			labels[metricTypeLabel] = metricTypePackets
-			n.counterVec.With(labels).Add((*incremental)[name].Packets)
-			labels[metricTypeLabel] = metricTypeBytes
-			n.counterVec.With(labels).Add((*incremental)[name].Bytes)
+		// in collector mode the counters are read on scrape instead
+		if n.counterVec != nil {
+			for key := range *incremental {
+				labels[deviceNameLabel] = key.Device
+				labels[directionLabel] = key.Direction
+				labels[ipFamilyLabel] = key.Family
+				labels[metricTypeLabel] = metricTypePackets
+				n.counterVec.With(labels).Add((*incremental)[key].Packets)
+				labels[metricTypeLabel] = metricTypeBytes
+				n.counterVec.With(labels).Add((*incremental)[key].Bytes)
+			}
 		}
 		n.logger.Printf("tick on %s completed", lastTick)
 	}
 }
 
-func (n *NetworkUsageMonitor) GetCurrentUsage() *map[string]DeviceUsage {
-	cmd := exec.Command("bash", "-c", n.command)
-	var stdout, stderr bytes.Buffer
-    cmd.Stdout = &stdout
-    cmd.Stderr = &stderr
-    if err := cmd.Run(); err != nil {
-		n.logger.Printf(fmt.Sprintf("got error while running command: %q\n", err.Error()))
-        return nil
-    }
-	if stderr.Len() > 0 {
-		n.logger.Printf(fmt.Sprintf("got stderr: %q\n", stderr.String()))
-		return nil
+// reconcileRules keeps the counters readable when the inventory is broken, the
+// rules are left as they are then
+func (n *NetworkUsageMonitor) reconcileRules() {
+	var inventory, err = loadInventory(n.inventoryFile)
+	if err != nil {
+		n.logger.Printf("failed to load inventory from %q: %s", n.inventoryFile, err)
+		n.lock.Lock()
+		n.lastReconcileError = err
+		n.lock.Unlock()
+		return
 	}
-	n.lastStdOut = stdout.String()
-
-	lines := bytes.Split(stdout.Bytes(), []byte("\n"))
-	usage := make(map[string]DeviceUsage)
-	for _, line := range lines {
-		if len(line) == 0 {
-			continue
+	var plan = []string{}
+	for _, manager := range n.ruleManagers {
+		var commands []string
+		commands, err = manager.reconcile(manager.desiredRules(inventory))
+		plan = append(plan, commands...)
+		if err != nil {
+			n.logger.Printf("failed to reconcile rules with %s: %s", manager.command, err)
+			break
 		}
-		var cols = bytes.Split(line, []byte(" "))
-		if len(cols) < 3 {
-			n.logger.Printf(fmt.Sprintf("invalid line: %q\n", line))
-			continue
-		}
-		var deviceName = string(cols[2])
-		var packetCount, packetErr = strconv.ParseFloat(string(cols[0]), 64)
-		if packetErr != nil {
-			n.logger.Printf(fmt.Sprintf("invalid packet cnt: %q\n", line))
+	}
+	if err == nil {
+		n.logger.Printf("reconciled rules of %d devices with %d commands", len(inventory), len(plan))
+	}
+	n.lock.Lock()
+	n.lastPlan, n.lastReconcileError = plan, err
+	n.lock.Unlock()
+}
+
+// GetCurrentUsage reads the backend and leaves the state of the monitor alone
+func (n *NetworkUsageMonitor) GetCurrentUsage() (*map[usageKey]DeviceUsage, []byte, []string, error) {
+	var usage, stdout, warnings, err = n.backend.ReadUsage()
+	if err != nil {
+		n.logger.Printf("got error while reading usage from %s: %s", n.backend.Name(), err)
+		return nil, stdout, warnings, err
+	}
+	return &usage, stdout, warnings, nil
+}
+
+// GetIncremental treats a current value lower than the last known one as a
+// fresh counter, as happens when the chain is flushed or the pi reboots
+func (n *NetworkUsageMonitor) GetIncremental(lastKnown *map[usageKey]DeviceUsage, currentValues *map[usageKey]DeviceUsage) *map[usageKey]DeviceUsage {
+	var ret = make(map[usageKey]DeviceUsage)
+	for key, current := range *currentValues {
+		var last, ok = (*lastKnown)[key]
+		if !ok {
+			n.logger.Printf("device %q not found in last known usage", key)
+			ret[key] = current
 			continue
 		}
-		// parse cols[1] as float64
-		var byteCount, byteErr = strconv.ParseFloat(string(cols[1]), 64)
-		if byteErr != nil {
-			n.logger.Printf(fmt.Sprintf("invalid bytes cnt: %q\n", line))
+		if isCounterReset(last, current) {
+			n.logger.Printf("counter of device %q was reset, last known %+v, current %+v", key, last, current)
+			ret[key] = current
 			continue
 		}
-		usage[deviceName] = DeviceUsage{
-			Packets: packetCount,
-			Bytes:   byteCount,
+		ret[key] = DeviceUsage{
+			Packets: current.Packets - last.Packets,
+			Bytes:   current.Bytes - last.Bytes,
 		}
 	}
+	return &ret
+}
 
-	return &usage;
+func isCounterReset(last DeviceUsage, current DeviceUsage) bool {
+	return current.Packets < last.Packets || current.Bytes < last.Bytes
 }
 
-func (n *NetworkUsageMonitor) GetIncremental(lastKnown *map[string]DeviceUsage, currentValues *map[string]DeviceUsage) *map[string]DeviceUsage {
-	var ret = make(map[string]DeviceUsage)
-	for name, current := range *currentValues {
-		var last, ok = (*lastKnown)[name]
-		if !ok {
-			n.logger.Printf(fmt.Sprintf("device %q not found in last known usage", name))
-			ret[name] = DeviceUsage{
-				Packets: current.Packets,
-				Bytes:   current.Bytes,
-			}
+type usageBaseline struct {
+	SavedAt time.Time                `json:"savedAt"`
+	Usage   map[usageKey]DeviceUsage `json:"usage"`
+}
+
+// loadBaseline returns false when there is no baseline to continue from
+func (n *NetworkUsageMonitor) loadBaseline() bool {
+	var jsonBytes, err = ioutil.ReadFile(n.baselineFile)
+	if os.IsNotExist(err) {
+		n.logger.Printf("baseline file %q not found", n.baselineFile)
+		return false
+	}
+	var baseline = usageBaseline{}
+	if err == nil {
+		err = json.Unmarshal(jsonBytes, &baseline)
+	}
+	if err != nil || baseline.Usage == nil {
+		n.logger.Printf("failed to load baseline from %q: %v", n.baselineFile, err)
+		return false
+	}
+	// a baseline from before ipv6 accounting has no families, only iptables
+	// is sure to have counted ipv4 alone
+	for key, usage := range baseline.Usage {
+		if key.Family != "" {
+			continue
 		}
-		ret[name] = DeviceUsage{
-			Packets: current.Packets - last.Packets,
-			Bytes:   current.Bytes - last.Bytes,
+		if n.backend.Name() != usageBackendIptables {
+			n.logger.Printf("baseline from %q has no ip families, starting over", n.baselineFile)
+			return false
 		}
+		delete(baseline.Usage, key)
+		key.Family = familyIpv4
+		baseline.Usage[key] = usage
 	}
-	return &ret
-}
\ No newline at end of file
+	n.logger.Printf("loaded baseline of %d devices saved on %s", len(baseline.Usage), baseline.SavedAt)
+	n.lastKnownValue = &baseline.Usage
+	return true
+}
+
+func (n *NetworkUsageMonitor) saveBaseline() {
+	var jsonBytes, err = json.Marshal(usageBaseline{SavedAt: time.Now(), Usage: *n.lastKnownValue})
+	if err == nil {
+		err = utils.WriteFileAtomically(n.baselineFile, jsonBytes)
+	}
+	if err != nil {
+		n.logger.Printf("failed to save baseline to %q: %s", n.baselineFile, err)
+	}
+}
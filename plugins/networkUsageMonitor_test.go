@@ -0,0 +1,67 @@
+package plugins
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// run with -race, the pages are served while the ticker replaces the state
+func TestDebugPagesWhileTicking(t *testing.T) {
+	var key = usageKey{Device: "tv", Direction: directionUp, Family: familyIpv4}
+	var backend = &fakeBackend{name: usageBackendIptables, stdout: "-A NETWORK-FILTER\n", usage: map[usageKey]DeviceUsage{key: {Packets: 1, Bytes: 100}}}
+	var n = newTestUsageMonitor(t, backend)
+	n.command = backend.Command()
+	n.hasBaseline = true
+	n.refreshIntervalInSeconds = 1
+	n.resetCounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{Name: networkUsageMonitorResetsMetricName}, []string{deviceNameLabel, directionLabel, ipFamilyLabel})
+	n.ticker = time.NewTicker(time.Millisecond)
+	defer n.ticker.Stop()
+	go n.ticking()
+
+	// until at least 10 ticks read besides the reads of the page
+	for i := 1; i <= 50 || backend.readCount()-(i-1) < 10; i++ {
+		backend.set(map[usageKey]DeviceUsage{key: {Packets: float64(i), Bytes: float64(100 * i)}}, nil)
+		var rw = httptest.NewRecorder()
+		n.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), "backend: iptables\n") || !strings.Contains(rw.Body.String(), "counters of the last tick:") {
+			t.Fatalf("got %d with\n%s", rw.Code, rw.Body.String())
+		}
+		rw = httptest.NewRecorder()
+		n.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/read", nil))
+		var body = rw.Body.String()
+		if rw.Code != http.StatusOK || !strings.Contains(body, "std out:\n-A NETWORK-FILTER\n") || !strings.Contains(body, fmt.Sprintf("up ipv4: %d packets", i)) {
+			t.Fatalf("got %d with\n%s", rw.Code, body)
+		}
+	}
+
+	// once a tick failed the baseline is no longer saved into the temporary directory
+	backend.set(nil, fmt.Errorf("iptables: not found"))
+	for i := 0; true; i++ {
+		n.lock.Lock()
+		var failed = n.lastReadError != nil
+		n.lock.Unlock()
+		if failed {
+			break
+		}
+		if i == 1000 {
+			t.Fatal("expected a tick to fail")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	var rw = httptest.NewRecorder()
+	n.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/read", nil))
+	if !strings.Contains(rw.Body.String(), "read error: iptables: not found\n") {
+		t.Errorf("got\n%s", rw.Body.String())
+	}
+	rw = httptest.NewRecorder()
+	n.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/read", nil))
+	if rw.Code != http.StatusMethodNotAllowed || rw.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("got %d, want a read only on POST", rw.Code)
+	}
+}
@@ -0,0 +1,287 @@
+// with NAME_RESOLUTION set, devices are also named from their addresses, so
+// rules without a "device_name:" comment and captured traffic of devices not in
+// the inventory are counted too, names are looked up in order from
+//   - NAMES_FILE, overrides keyed by mac, ip or a name to rename, like
+//     {"aa:bb:cc:dd:ee:ff": "tv", "192.168.1.50": "printer", "old-tv": "tv"}
+//   - the hostnames of dnsmasq (DNSMASQ_LEASES_FILE) and ISC dhcpd
+//     (DHCPD_LEASES_FILE) leases, by mac and then by ip
+//   - the mac of the ip in ARP_FILE, reported as "unknown:<mac>"
+//
+// names and macs are kept after their lease or arp entry expires, a rule that
+// lost its name would be dropped and counted in full again once named
+//
+// renaming by mac keeps the history of a device whose hostname changes, the
+// files are read again at most every NAMES_REFRESH_INTERVAL_IN_SECONDS
+
+package plugins
+
+import (
+	"bufio"
+	"encoding/json"
+	"garfield/rpi-api-server/utils"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const unknownDevicePrefix = "unknown:"
+
+var dhcpdLeasePattern = regexp.MustCompile(`(?s)lease\s+(\S+)\s*\{(.*?)\}`)
+var dhcpdMacPattern = regexp.MustCompile(`hardware\s+ethernet\s+([0-9a-fA-F:]+);`)
+var dhcpdHostnamePattern = regexp.MustCompile(`client-hostname\s+"([^"]*)";`)
+var invalidNamePattern = regexp.MustCompile(`[\s/]+`)
+
+type nameResolver struct {
+	namesFile         string
+	dnsmasqLeasesFile string
+	dhcpdLeasesFile   string
+	arpFile           string
+	refreshInterval   time.Duration
+	logger            *log.Logger
+
+	lock       sync.Mutex
+	loadedAt   time.Time
+	overrides  map[string]string
+	macToName  map[string]string
+	ipToName   map[string]string
+	ipToMac    map[string]string
+	lastErrors []string
+}
+
+// newNameResolver returns nil when NAME_RESOLUTION is off, a nil resolver names nothing
+func newNameResolver(logger *log.Logger) *nameResolver {
+	var enabled = utils.GetEnvVarBool("NAME_RESOLUTION", false)
+	logger.Printf("NAME_RESOLUTION: %t", enabled)
+	if !enabled {
+		return nil
+	}
+	return &nameResolver{
+		namesFile:         utils.GetEnvVarString("NAMES_FILE", ""),
+		dnsmasqLeasesFile: utils.GetEnvVarString("DNSMASQ_LEASES_FILE", "/var/lib/misc/dnsmasq.leases"),
+		dhcpdLeasesFile:   utils.GetEnvVarString("DHCPD_LEASES_FILE", "/var/lib/dhcp/dhcpd.leases"),
+		arpFile:           utils.GetEnvVarString("ARP_FILE", "/proc/net/arp"),
+		refreshInterval:   time.Duration(utils.GetEnvVarInt("NAMES_REFRESH_INTERVAL_IN_SECONDS", 60)) * time.Second,
+		logger:            logger,
+	}
+}
+
+// refresh expects the lock to be held, missing files are fine as a network
+// has only one of the dhcp servers
+func (r *nameResolver) refresh() {
+	if time.Since(r.loadedAt) < r.refreshInterval {
+		return
+	}
+	r.loadedAt = time.Now()
+	var lastMacToName, lastIpToName, lastIpToMac = r.macToName, r.ipToName, r.ipToMac
+	r.overrides, r.macToName, r.ipToName, r.ipToMac = map[string]string{}, map[string]string{}, map[string]string{}, map[string]string{}
+	r.lastErrors = []string{}
+	var fail = func(filePath string, err error) {
+		if err != nil && !os.IsNotExist(err) {
+			r.lastErrors = append(r.lastErrors, err.Error())
+			r.logger.Printf("failed to read %q: %s", filePath, err)
+		}
+	}
+	if r.namesFile != "" {
+		var overrides = map[string]string{}
+		var jsonBytes, err = ioutil.ReadFile(r.namesFile)
+		if err == nil {
+			err = json.Unmarshal(jsonBytes, &overrides)
+		}
+		fail(r.namesFile, err)
+		for key, name := range overrides {
+			r.overrides[normalizeAddress(key)] = sanitizeName(name)
+		}
+	}
+	fail(r.dnsmasqLeasesFile, r.readDnsmasqLeases())
+	fail(r.dhcpdLeasesFile, r.readDhcpdLeases())
+	fail(r.arpFile, r.readArp())
+	// expired leases and arp entries keep naming their device
+	keepMissing(r.macToName, lastMacToName)
+	keepMissing(r.ipToName, lastIpToName)
+	keepMissing(r.ipToMac, lastIpToMac)
+}
+
+func keepMissing(current map[string]string, last map[string]string) {
+	for key, value := range last {
+		if _, exists := current[key]; !exists {
+			current[key] = value
+		}
+	}
+}
+
+func (r *nameResolver) lease(mac string, ip string, hostname string) {
+	if net.ParseIP(ip) == nil {
+		return
+	}
+	var ipKey = normalizeAddress(ip)
+	if mac != "" {
+		r.ipToMac[ipKey] = normalizeAddress(mac)
+	}
+	if hostname == "" || hostname == "*" {
+		return
+	}
+	if mac != "" {
+		r.macToName[normalizeAddress(mac)] = sanitizeName(hostname)
+	}
+	r.ipToName[ipKey] = sanitizeName(hostname)
+}
+
+// readDnsmasqLeases reads lines like "expiry mac ip hostname client-id"
+func (r *nameResolver) readDnsmasqLeases() error {
+	var content, err = ioutil.ReadFile(r.dnsmasqLeasesFile)
+	if err != nil {
+		return err
+	}
+	var scanner = bufio.NewScanner(strings.NewReader(string(content)))
+	for scanner.Scan() {
+		var fields = strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		r.lease(fields[1], fields[2], fields[3])
+	}
+	return nil
+}
+
+// readDhcpdLeases reads lease blocks, a later block of an ip replaces the earlier ones
+func (r *nameResolver) readDhcpdLeases() error {
+	var content, err = ioutil.ReadFile(r.dhcpdLeasesFile)
+	if err != nil {
+		return err
+	}
+	for _, match := range dhcpdLeasePattern.FindAllStringSubmatch(string(content), -1) {
+		var mac, hostname = "", ""
+		if found := dhcpdMacPattern.FindStringSubmatch(match[2]); found != nil {
+			mac = found[1]
+		}
+		if found := dhcpdHostnamePattern.FindStringSubmatch(match[2]); found != nil {
+			hostname = found[1]
+		}
+		r.lease(mac, match[1], hostname)
+	}
+	return nil
+}
+
+// readArp reads /proc/net/arp, incomplete entries have flags 0x0
+func (r *nameResolver) readArp() error {
+	var content, err = ioutil.ReadFile(r.arpFile)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		var fields = strings.Fields(line)
+		if len(fields) < 4 || fields[2] == "0x0" || net.ParseIP(fields[0]) == nil {
+			continue
+		}
+		if _, exists := r.ipToMac[normalizeAddress(fields[0])]; !exists {
+			r.ipToMac[normalizeAddress(fields[0])] = normalizeAddress(fields[3])
+		}
+	}
+	return nil
+}
+
+// normalizeAddress makes macs and ips comparable, other keys are kept
+func normalizeAddress(address string) string {
+	if mac, err := net.ParseMAC(address); err == nil {
+		return mac.String()
+	}
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+	return address
+}
+
+func sanitizeName(name string) string {
+	return invalidNamePattern.ReplaceAllString(strings.ToLower(strings.TrimSpace(name)), "-")
+}
+
+// rename applies the overrides to a name from a comment or the inventory
+func (r *nameResolver) rename(name string) string {
+	if r == nil {
+		return name
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.refresh()
+	if renamed, exists := r.overrides[name]; exists {
+		return renamed
+	}
+	return name
+}
+
+// nameOf names a device by its mac or ip, the mac falls back to the one in
+// the arp table, a device with only a mac is "unknown:<mac>"
+func (r *nameResolver) nameOf(mac string, ip string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.refresh()
+	if ip != "" {
+		ip = normalizeAddress(ip)
+	}
+	if mac == "" && ip != "" {
+		mac = r.ipToMac[ip]
+	}
+	if mac != "" {
+		mac = normalizeAddress(mac)
+		if name, exists := r.overrides[mac]; exists {
+			return name, true
+		}
+	}
+	if name, exists := r.overrides[ip]; exists && ip != "" {
+		return name, true
+	}
+	if name, exists := r.macToName[mac]; exists && mac != "" {
+		return name, true
+	}
+	if name, exists := r.ipToName[ip]; exists && ip != "" {
+		return name, true
+	}
+	if mac != "" {
+		return unknownDevicePrefix + mac, true
+	}
+	return "", false
+}
+
+// nameOfRule names a rule by its single local host, the source if it is
+// one, else the destination
+func (r *nameResolver) nameOfRule(direction *directionConfig, source string, destination string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	for _, address := range []string{source, destination} {
+		var network = parseAddress(address)
+		if network == nil || !direction.isLocal(address) {
+			continue
+		}
+		if ones, bits := network.Mask.Size(); ones != bits {
+			continue
+		}
+		return r.nameOf("", network.IP.String())
+	}
+	return "", false
+}
+
+func (r *nameResolver) errors() []string {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lastErrors
+}
+
+// ruleDeviceName names a rule by its comment, or else by its addresses
+func ruleDeviceName(comment string, commentKey string, names *nameResolver, direction *directionConfig, source string, destination string) (string, bool) {
+	if name, found := deviceNameFromComment(comment, commentKey); found {
+		return names.rename(name), true
+	}
+	return names.nameOfRule(direction, source, destination)
+}
@@ -0,0 +1,75 @@
+package plugins
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const fakeArp = `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.50     0x1         0x2         aa:bb:cc:00:00:50     *        eth0
+192.168.1.51     0x1         0x0         00:00:00:00:00:00     *        eth0
+`
+
+const fakeDnsmasqLeases = "1767225600 aa:bb:cc:00:00:60 192.168.1.60 Printer *\n"
+
+// unnamedRules lists rules without a comment, named only by their address
+func unnamedRules(bytes int) []byte {
+	return []byte(fmt.Sprintf(`Chain NETWORK-FILTER (1 references)
+    pkts      bytes target     prot opt in     out     source               destination
+      10 %8d RETURN     all  --  *      *       192.168.1.50         0.0.0.0/0
+      10 %8d RETURN     all  --  *      *       192.168.1.60         0.0.0.0/0
+`, bytes, bytes))
+}
+
+func TestNamesKeptAfterExpiry(t *testing.T) {
+	var dir = t.TempDir()
+	var write = func(name string, content string) string {
+		var path = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	var names = &nameResolver{
+		arpFile:           write("arp", fakeArp),
+		dnsmasqLeasesFile: write("dnsmasq.leases", fakeDnsmasqLeases),
+		dhcpdLeasesFile:   filepath.Join(dir, "missing"),
+		logger:            log.New(ioutil.Discard, "", 0),
+	}
+	var direction = newDirectionConfig()
+	var first, _ = parseIptablesList(unnamedRules(1000), "device_name", direction, names)
+	var want = map[usageKey]DeviceUsage{
+		{Device: "unknown:aa:bb:cc:00:00:50", Direction: directionTotal}: {Packets: 10, Bytes: 1000},
+		{Device: "printer", Direction: directionTotal}:                   {Packets: 10, Bytes: 1000},
+	}
+	if !reflect.DeepEqual(first, want) {
+		t.Fatalf("got %v, want %v", first, want)
+	}
+	if name, found := names.nameOf("", "192.168.1.51"); found {
+		t.Errorf("incomplete arp entry named %q", name)
+	}
+
+	// the arp entry and the lease expire, both devices keep their name
+	write("arp", "IP address       HW type     Flags       HW address            Mask     Device\n")
+	write("dnsmasq.leases", "")
+	var second, _ = parseIptablesList(unnamedRules(1500), "device_name", direction, names)
+	var monitor = &NetworkUsageMonitor{logger: names.logger}
+	var incremental = monitor.GetIncremental(&first, &second)
+	want = map[usageKey]DeviceUsage{
+		{Device: "unknown:aa:bb:cc:00:00:50", Direction: directionTotal}: {Bytes: 500},
+		{Device: "printer", Direction: directionTotal}:                   {Bytes: 500},
+	}
+	if !reflect.DeepEqual(*incremental, want) {
+		t.Errorf("got %v, want %v", *incremental, want)
+	}
+
+	// a new lease of the ip names it again
+	write("dnsmasq.leases", "1767225600 aa:bb:cc:00:00:61 192.168.1.60 scanner *\n")
+	if name, _ := names.nameOf("", "192.168.1.60"); name != "scanner" {
+		t.Errorf("got %q, want scanner", name)
+	}
+}
@@ -0,0 +1,260 @@
+// read rule counters or named counters from `nft -j list ...` json output, for
+// systems without the iptables-legacy chain
+// in "rules" mode every rule of the chain with a comment like
+// "device_name: some-device" and a counter is used, in "counters" mode every
+// named counter of the table is used, named by its comment or else its name,
+// the direction is taken from the comment, and in rules mode also from the
+// ip saddr and daddr matches, the ip family from the table or the matches
+
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"garfield/rpi-api-server/utils"
+	"strings"
+)
+
+const nftablesModeRules = "rules"
+const nftablesModeCounters = "counters"
+
+type nftablesBackend struct {
+	command    string
+	family     string
+	table      string
+	mode       string
+	chainName  string
+	commentKey string
+	direction  *directionConfig
+	names      *nameResolver
+	run        commandRunner
+}
+
+type nftablesOutput struct {
+	Nftables []map[string]json.RawMessage `json:"nftables"`
+}
+
+type nftablesRule struct {
+	Family  string                       `json:"family"`
+	Table   string                       `json:"table"`
+	Chain   string                       `json:"chain"`
+	Comment string                       `json:"comment"`
+	Expr    []map[string]json.RawMessage `json:"expr"`
+}
+
+type nftablesCounter struct {
+	Family  string  `json:"family"`
+	Table   string  `json:"table"`
+	Name    string  `json:"name"`
+	Comment string  `json:"comment"`
+	Packets float64 `json:"packets"`
+	Bytes   float64 `json:"bytes"`
+}
+
+type nftablesMatch struct {
+	Op   string `json:"op"`
+	Left struct {
+		Payload *struct {
+			Protocol string `json:"protocol"`
+			Field    string `json:"field"`
+		} `json:"payload"`
+		Meta *struct {
+			Key string `json:"key"`
+		} `json:"meta"`
+	} `json:"left"`
+	Right json.RawMessage `json:"right"`
+}
+
+type nftablesPrefix struct {
+	Prefix struct {
+		Addr string `json:"addr"`
+		Len  int    `json:"len"`
+	} `json:"prefix"`
+}
+
+func newNftablesBackend(chainName string, commentKey string, direction *directionConfig, names *nameResolver, run commandRunner) *nftablesBackend {
+	var ret = &nftablesBackend{
+		command:    utils.GetEnvVarString("NFT_COMMAND", "nft"),
+		mode:       utils.GetEnvVarString("NFT_MODE", nftablesModeRules),
+		chainName:  chainName,
+		commentKey: commentKey,
+		direction:  direction,
+		names:      names,
+		run:        run,
+	}
+	// like "inet filter", the family and name of the table
+	var table = strings.Fields(utils.GetEnvVarString("NFT_TABLE", "inet filter"))
+	if len(table) != 2 {
+		panic(fmt.Sprintf("invalid nftables table: %q", table))
+	}
+	ret.family, ret.table = table[0], table[1]
+	if ret.mode != nftablesModeRules && ret.mode != nftablesModeCounters {
+		panic(fmt.Sprintf("invalid nftables mode: %q", ret.mode))
+	}
+	return ret
+}
+
+func (b *nftablesBackend) Name() string {
+	return usageBackendNftables
+}
+
+func (b *nftablesBackend) Command() string {
+	return strings.Join(append([]string{b.command}, b.args()...), " ")
+}
+
+func (b *nftablesBackend) args() []string {
+	if b.mode == nftablesModeCounters {
+		return []string{"-j", "list", "counters", "table", b.family, b.table}
+	}
+	return []string{"-j", "list", "chain", b.family, b.table, b.chainName}
+}
+
+func (b *nftablesBackend) ReadUsage() (map[usageKey]DeviceUsage, []byte, []string, error) {
+	var stdout, stderr, err = b.run(b.command, b.args()...)
+	if err != nil {
+		return nil, stdout, nil, fmt.Errorf("%s: %s, stderr: %q", b.Command(), err, stderr)
+	}
+	usage, warnings, err := parseNftables(stdout, b.mode, b.commentKey, b.direction, b.names)
+	if err != nil {
+		return nil, stdout, warnings, err
+	}
+	if len(stderr) > 0 {
+		warnings = append(warnings, fmt.Sprintf("stderr: %q", stderr))
+	}
+	return usage, stdout, warnings, nil
+}
+
+func parseNftables(output []byte, mode string, commentKey string, direction *directionConfig, names *nameResolver) (map[usageKey]DeviceUsage, []string, error) {
+	var parsed = nftablesOutput{}
+	if err := json.Unmarshal(output, &parsed); err != nil {
+		return nil, nil, fmt.Errorf("invalid nft json output: %s", err)
+	}
+	var usage = map[usageKey]DeviceUsage{}
+	var warnings = []string{}
+	for _, element := range parsed.Nftables {
+		var key usageKey
+		var counter nftablesCounter
+		switch {
+		case mode == nftablesModeRules && element["rule"] != nil:
+			var rule = nftablesRule{}
+			if err := json.Unmarshal(element["rule"], &rule); err != nil {
+				warnings = append(warnings, fmt.Sprintf("invalid rule: %s", err))
+				continue
+			}
+			var source, destination = ruleAddresses(rule)
+			var found bool
+			if key.Device, found = ruleDeviceName(rule.Comment, commentKey, names, direction, source, destination); !found {
+				continue
+			}
+			if counter, found = ruleCounter(rule); !found {
+				warnings = append(warnings, fmt.Sprintf("rule of %s has no counter", key.Device))
+				continue
+			}
+			key.Direction = direction.resolve(rule.Comment, source, destination)
+			key.Family = ruleFamily(rule)
+		case mode == nftablesModeCounters && element["counter"] != nil:
+			if err := json.Unmarshal(element["counter"], &counter); err != nil {
+				warnings = append(warnings, fmt.Sprintf("invalid counter: %s", err))
+				continue
+			}
+			var found bool
+			if key.Device, found = deviceNameFromComment(counter.Comment, commentKey); !found {
+				key.Device = counter.Name
+			}
+			key.Device = names.rename(key.Device)
+			key.Direction = direction.resolve(counter.Comment, "", "")
+			key.Family = tableFamily(counter.Family)
+		default:
+			continue
+		}
+		var current = usage[key]
+		current.Packets += counter.Packets
+		current.Bytes += counter.Bytes
+		usage[key] = current
+	}
+	return usage, warnings, nil
+}
+
+// ruleCounter finds the anonymous counter statement of a rule, references to
+// named counters are strings and skipped
+func ruleCounter(rule nftablesRule) (nftablesCounter, bool) {
+	for _, expr := range rule.Expr {
+		var raw, exists = expr["counter"]
+		if !exists {
+			continue
+		}
+		var counter = nftablesCounter{}
+		if err := json.Unmarshal(raw, &counter); err == nil {
+			return counter, true
+		}
+	}
+	return nftablesCounter{}, false
+}
+
+// ruleFamily is the family of the table, or in an inet table the one of the ip
+// or ip6 matches or of a "meta nfproto" match, a rule without them counts both
+func ruleFamily(rule nftablesRule) string {
+	var family = tableFamily(rule.Family)
+	if family != familyAny {
+		return family
+	}
+	for _, expr := range rule.Expr {
+		var raw, exists = expr["match"]
+		if !exists {
+			continue
+		}
+		var match = nftablesMatch{}
+		if err := json.Unmarshal(raw, &match); err != nil {
+			continue
+		}
+		if match.Left.Payload != nil {
+			switch match.Left.Payload.Protocol {
+			case "ip":
+				return familyIpv4
+			case "ip6":
+				return familyIpv6
+			}
+		}
+		var proto string
+		if match.Left.Meta != nil && match.Left.Meta.Key == "nfproto" && match.Op == "==" && json.Unmarshal(match.Right, &proto) == nil {
+			if proto == familyIpv4 || proto == familyIpv6 {
+				return proto
+			}
+		}
+	}
+	return familyAny
+}
+
+// ruleAddresses finds the "==" matches of ip or ip6 saddr and daddr, sets and
+// other operators are left out
+func ruleAddresses(rule nftablesRule) (string, string) {
+	var source, destination = "", ""
+	for _, expr := range rule.Expr {
+		var raw, exists = expr["match"]
+		if !exists {
+			continue
+		}
+		var match = nftablesMatch{}
+		if err := json.Unmarshal(raw, &match); err != nil || match.Left.Payload == nil || match.Op != "==" {
+			continue
+		}
+		if match.Left.Payload.Protocol != "ip" && match.Left.Payload.Protocol != "ip6" {
+			continue
+		}
+		var address string
+		var prefix = nftablesPrefix{}
+		if err := json.Unmarshal(match.Right, &address); err != nil {
+			if err = json.Unmarshal(match.Right, &prefix); err != nil || prefix.Prefix.Addr == "" {
+				continue
+			}
+			address = fmt.Sprintf("%s/%d", prefix.Prefix.Addr, prefix.Prefix.Len)
+		}
+		switch match.Left.Payload.Field {
+		case "saddr":
+			source = address
+		case "daddr":
+			destination = address
+		}
+	}
+	return source, destination
+}
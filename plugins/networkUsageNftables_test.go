@@ -0,0 +1,66 @@
+package plugins
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// the rules fixture holds one rule per direction of tv, three rules of pc
+// without a direction, an ipv6, an ipv4 and one of any family, a rule of nas
+// that references a named counter and a rule without a comment
+func TestParseNftablesRules(t *testing.T) {
+	var usage, warnings, err = parseNftables(readFixture(t, "nft-rules.json"), nftablesModeRules, "device_name", newDirectionConfig(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want = map[usageKey]DeviceUsage{
+		{Device: "tv", Direction: directionUp, Family: familyIpv4}:    {Packets: 1520, Bytes: 204800},
+		{Device: "tv", Direction: directionDown, Family: familyIpv4}:  {Packets: 3100, Bytes: 4096000},
+		{Device: "pc", Direction: directionTotal, Family: familyIpv6}: {Packets: 12, Bytes: 960},
+		{Device: "pc", Direction: directionTotal, Family: familyIpv4}: {Packets: 8, Bytes: 640},
+		{Device: "pc", Direction: directionTotal, Family: familyAny}:  {Packets: 4, Bytes: 320},
+	}
+	if !reflect.DeepEqual(usage, want) {
+		t.Errorf("got %v, want %v", usage, want)
+	}
+	if !reflect.DeepEqual(warnings, []string{"rule of nas has no counter"}) {
+		t.Errorf("got warnings %q, want one for the named counter reference", warnings)
+	}
+}
+
+func TestParseNftablesRulesDirectionFromAddresses(t *testing.T) {
+	var _, local, _ = net.ParseCIDR("192.168.0.0/16")
+	var direction = &directionConfig{mode: directionModeAddress, commentKey: "dir", localNetworks: []*net.IPNet{local}}
+	var usage, _, err = parseNftables(readFixture(t, "nft-rules.json"), nftablesModeRules, "device_name", direction, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rule of pc matching its address as destination is download
+	var key = usageKey{Device: "pc", Direction: directionDown, Family: familyIpv4}
+	if usage[key] != (DeviceUsage{Packets: 8, Bytes: 640}) {
+		t.Errorf("got %v, want the ipv4 rule of pc as download", usage)
+	}
+}
+
+func TestParseNftablesCounters(t *testing.T) {
+	var usage, warnings, err = parseNftables(readFixture(t, "nft-counters.json"), nftablesModeCounters, "device_name", newDirectionConfig(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want = map[usageKey]DeviceUsage{
+		{Device: "tv", Direction: directionUp, Family: familyAny}:          {Packets: 1520, Bytes: 204800},
+		{Device: "tv", Direction: directionDown, Family: familyAny}:        {Packets: 3100, Bytes: 4096000},
+		{Device: "printer", Direction: directionTotal, Family: familyIpv6}: {Packets: 5, Bytes: 400},
+	}
+	if !reflect.DeepEqual(usage, want) || len(warnings) != 0 {
+		t.Errorf("got %v with warnings %q, want %v", usage, warnings, want)
+	}
+	// each mode only reads its own elements
+	if usage, _, _ = parseNftables(readFixture(t, "nft-rules.json"), nftablesModeCounters, "device_name", newDirectionConfig(), nil); len(usage) != 0 {
+		t.Errorf("got %v from rules in counters mode, want none", usage)
+	}
+	if _, _, err = parseNftables([]byte("Error: No such file"), nftablesModeRules, "device_name", newDirectionConfig(), nil); err == nil {
+		t.Errorf("expected an error for output that is not json")
+	}
+}
@@ -0,0 +1,449 @@
+// data budgets of devices or groups of devices, read from QUOTAS_FILE like
+//
+//	{
+//	    "kids": {"devices": ["tablet", "switch"], "period": "monthly", "resetDay": 1, "limitBytes": 20000000000,
+//	             "warnPercents": [50, 80, 100], "action": "ratelimit", "rateLimit": "50/second"},
+//	    "tv": {"devices": ["tv"], "period": "daily", "limitBytes": 5000000000}
+//	}
+//
+// the bytes of both directions count, the period is daily, weekly (resetDay is
+// the weekday, 0 for sunday) or monthly (resetDay is the day of month, up to
+// 28, the 1st when 0), a warning is pushed when usage crosses each percentage, and once the
+// limit is exceeded the optional action "drop" drops the traffic of the
+// devices, "ratelimit" limits it to rateLimit packets, both by rules in the
+// QUOTA_CHAIN chain built from the addresses in INVENTORY_FILE, the rules are
+// removed when the period resets
+
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"garfield/rpi-api-server/utils"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const quotaPeriodDaily = "daily"
+const quotaPeriodWeekly = "weekly"
+const quotaPeriodMonthly = "monthly"
+
+const quotaActionDrop = "drop"
+const quotaActionRateLimit = "ratelimit"
+
+const networkUsageNotificationTitle = "Network Usage"
+
+var rateLimitPattern = regexp.MustCompile(`^(\d+)/(second|sec|s|minute|min|m|hour|h|day|d)$`)
+
+type Quota struct {
+	Devices      []string `json:"devices"`
+	Period       string   `json:"period"`
+	ResetDay     int      `json:"resetDay,omitempty"`
+	LimitBytes   float64  `json:"limitBytes"`
+	WarnPercents []int    `json:"warnPercents,omitempty"`
+	Action       string   `json:"action,omitempty"`
+	// packets like "50/second", for the ratelimit action
+	RateLimit      string `json:"rateLimit,omitempty"`
+	RateLimitBurst int    `json:"rateLimitBurst,omitempty"`
+}
+
+// QuotaState is persisted to QUOTA_STATE_FILE, so restarts keep the usage
+type QuotaState struct {
+	PeriodStart time.Time `json:"periodStart"`
+	UsedBytes   float64   `json:"usedBytes"`
+	Warned      []int     `json:"warned"`
+	Exceeded    bool      `json:"exceeded"`
+}
+
+type QuotaStatus struct {
+	Name string `json:"name"`
+	Quota
+	QuotaState
+	PeriodEnd time.Time `json:"periodEnd"`
+	Percent   float64   `json:"percent"`
+	Enforced  bool      `json:"enforced"`
+}
+
+type usageQuotas struct {
+	quotasFile    string
+	stateFile     string
+	inventoryFile string
+	priority      int
+	pusher        utils.NotificationPusher
+	managers      []*ruleManager
+	logger        *log.Logger
+
+	lock   sync.Mutex
+	quotas map[string]Quota
+	states map[string]*QuotaState
+	// error of the last enforcement, shown on /quotas
+	lastEnforceError error
+}
+
+// newUsageQuotas returns nil when QUOTAS_FILE is not set
+func newUsageQuotas(inventoryFile string, run commandRunner, logger *log.Logger) *usageQuotas {
+	var quotasFile = utils.GetEnvVarString("QUOTAS_FILE", "")
+	logger.Printf("QUOTAS_FILE: %q", quotasFile)
+	if quotasFile == "" {
+		return nil
+	}
+	var ret = &usageQuotas{
+		quotasFile:    quotasFile,
+		stateFile:     utils.GetEnvVarString("QUOTA_STATE_FILE", "network_usage_quotas.json"),
+		inventoryFile: inventoryFile,
+		priority:      utils.GetEnvVarInt("QUOTA_NOTIFICATION_PRIORITY", 0),
+		logger:        logger,
+		states:        map[string]*QuotaState{},
+	}
+	if err := ret.loadQuotas(); err != nil {
+		panic(fmt.Sprintf("failed to load quotas: %s", err))
+	}
+	if utils.GetEnvVarString("PUSH_SERVICE", "") != "" {
+		ret.pusher = utils.GetNotificationPusher()
+	}
+	for _, quota := range ret.quotas {
+		if quota.Action == "" {
+			continue
+		}
+		if inventoryFile == "" {
+			panic("quota actions need INVENTORY_FILE for the addresses of devices")
+		}
+		var quotaChain = utils.GetEnvVarString("QUOTA_CHAIN", "NETWORK-QUOTA")
+		// blocked devices would get through over ipv6, accounted or not
+		ret.managers = newRuleManagers(quotaChain, "", "", true, run, logger)
+		for _, manager := range ret.managers {
+			manager.rebuild = true
+		}
+		break
+	}
+	ret.loadStates()
+	return ret
+}
+
+func (q *usageQuotas) loadQuotas() error {
+	var jsonBytes, err = ioutil.ReadFile(q.quotasFile)
+	if err != nil {
+		return err
+	}
+	var quotas = map[string]Quota{}
+	if err = json.Unmarshal(jsonBytes, &quotas); err != nil {
+		return err
+	}
+	for name, quota := range quotas {
+		if err = validateQuota(quota); err != nil {
+			return fmt.Errorf("quota %s is invalid: %s", name, err)
+		}
+	}
+	q.quotas = quotas
+	return nil
+}
+
+func validateQuota(quota Quota) error {
+	if len(quota.Devices) == 0 {
+		return fmt.Errorf("no devices")
+	}
+	if quota.LimitBytes <= 0 {
+		return fmt.Errorf("limit must be positive")
+	}
+	switch quota.Period {
+	case quotaPeriodDaily:
+	case quotaPeriodWeekly:
+		if quota.ResetDay < 0 || quota.ResetDay > 6 {
+			return fmt.Errorf("reset day of a weekly quota must be 0 to 6")
+		}
+	case quotaPeriodMonthly:
+		if quota.ResetDay < 0 || quota.ResetDay > 28 {
+			return fmt.Errorf("reset day of a monthly quota must be 1 to 28, or 0 for the 1st")
+		}
+	default:
+		return fmt.Errorf("invalid period %q", quota.Period)
+	}
+	for _, percent := range quota.WarnPercents {
+		if percent <= 0 {
+			return fmt.Errorf("invalid warning percentage %d", percent)
+		}
+	}
+	switch quota.Action {
+	case "", quotaActionDrop:
+	case quotaActionRateLimit:
+		if _, err := iptablesLimit(quota.RateLimit); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid action %q", quota.Action)
+	}
+	return nil
+}
+
+// iptablesLimit returns the limit in the form `iptables -S` prints it
+func iptablesLimit(rateLimit string) (string, error) {
+	var match = rateLimitPattern.FindStringSubmatch(rateLimit)
+	if match == nil {
+		return "", fmt.Errorf("invalid rate limit %q, expecting like 50/second", rateLimit)
+	}
+	var unit = map[string]string{
+		"second": "sec", "sec": "sec", "s": "sec",
+		"minute": "min", "min": "min", "m": "min",
+		"hour": "hour", "h": "hour",
+		"day": "day", "d": "day",
+	}[match[2]]
+	return fmt.Sprintf("%s/%s", match[1], unit), nil
+}
+
+// periodStart returns the start of the period containing now, in local time
+func periodStart(quota Quota, now time.Time) time.Time {
+	var midnight = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch quota.Period {
+	case quotaPeriodWeekly:
+		var days = (int(now.Weekday()) - quota.ResetDay + 7) % 7
+		return midnight.AddDate(0, 0, -days)
+	case quotaPeriodMonthly:
+		var resetDay = quota.ResetDay
+		if resetDay == 0 {
+			resetDay = 1
+		}
+		var start = time.Date(now.Year(), now.Month(), resetDay, 0, 0, 0, 0, now.Location())
+		if now.Before(start) {
+			start = start.AddDate(0, -1, 0)
+		}
+		return start
+	}
+	return midnight
+}
+
+func periodEnd(quota Quota, start time.Time) time.Time {
+	switch quota.Period {
+	case quotaPeriodWeekly:
+		return start.AddDate(0, 0, 7)
+	case quotaPeriodMonthly:
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+func (q *usageQuotas) loadStates() {
+	var jsonBytes, err = ioutil.ReadFile(q.stateFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(jsonBytes, &q.states)
+	}
+	if err != nil {
+		q.logger.Printf("failed to load quota states from %q: %s", q.stateFile, err)
+		q.states = map[string]*QuotaState{}
+	}
+}
+
+// saveStates expects the lock to be held
+func (q *usageQuotas) saveStates() {
+	var jsonBytes, err = json.MarshalIndent(q.states, "", "    ")
+	if err == nil {
+		err = utils.WriteFileAtomically(q.stateFile, jsonBytes)
+	}
+	if err != nil {
+		q.logger.Printf("failed to save quota states to %q: %s", q.stateFile, err)
+	}
+}
+
+// state expects the lock to be held, it starts a new period when due
+func (q *usageQuotas) state(name string, quota Quota, now time.Time) *QuotaState {
+	var start = periodStart(quota, now)
+	var state, exists = q.states[name]
+	if !exists || !state.PeriodStart.Equal(start) {
+		if exists {
+			q.logger.Printf("quota %s used %.0f bytes in the period from %s, starting a new one", name, state.UsedBytes, state.PeriodStart)
+		}
+		state = &QuotaState{PeriodStart: start, Warned: []int{}}
+		q.states[name] = state
+	}
+	return state
+}
+
+// currentState expects the lock to be held, it returns a copy of the state
+// without starting a new period, a period that is due reads as a fresh one
+func (q *usageQuotas) currentState(name string, quota Quota, now time.Time) QuotaState {
+	var start = periodStart(quota, now)
+	if state, exists := q.states[name]; exists && state.PeriodStart.Equal(start) {
+		return *state
+	}
+	return QuotaState{PeriodStart: start, Warned: []int{}}
+}
+
+// account adds the usage of a tick, then warns and enforces as needed
+func (q *usageQuotas) account(incremental map[usageKey]DeviceUsage, now time.Time) {
+	q.lock.Lock()
+	var messages = []string{}
+	for _, name := range q.names() {
+		var quota = q.quotas[name]
+		var state = q.state(name, quota, now)
+		var devices = map[string]bool{}
+		for _, device := range quota.Devices {
+			devices[device] = true
+		}
+		for key, usage := range incremental {
+			if devices[key.Device] {
+				state.UsedBytes += usage.Bytes
+			}
+		}
+		var percent = state.UsedBytes / quota.LimitBytes * 100
+		for _, warnPercent := range quota.WarnPercents {
+			if percent < float64(warnPercent) || containsInt(state.Warned, warnPercent) {
+				continue
+			}
+			state.Warned = append(state.Warned, warnPercent)
+			messages = append(messages, fmt.Sprintf("quota %s used %d%% of %s %s, %s used",
+				name, warnPercent, formatBytes(quota.LimitBytes), quota.Period, formatBytes(state.UsedBytes)))
+		}
+		if !state.Exceeded && state.UsedBytes >= quota.LimitBytes {
+			state.Exceeded = true
+			var message = fmt.Sprintf("quota %s of %s %s is exceeded", name, formatBytes(quota.LimitBytes), quota.Period)
+			if quota.Action != "" {
+				message += fmt.Sprintf(", applying %s until %s", quota.Action, periodEnd(quota, state.PeriodStart).Format("2006-01-02 15:04"))
+			}
+			messages = append(messages, message)
+		}
+	}
+	q.saveStates()
+	q.lock.Unlock()
+
+	for _, message := range messages {
+		q.logger.Printf("%s", message)
+		if q.pusher == nil {
+			continue
+		}
+		if err := q.pusher.Send(networkUsageNotificationTitle, message, q.priority); err != nil {
+			q.logger.Printf("failed to send notification: %s", err)
+		}
+	}
+	if q.managers != nil {
+		q.enforce()
+	}
+}
+
+// names expects the lock to be held
+func (q *usageQuotas) names() []string {
+	var ret = []string{}
+	for name := range q.quotas {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// desiredRules expects the lock to be held
+func (q *usageQuotas) desiredRules(manager *ruleManager, inventory map[string]InventoryDevice) [][]string {
+	var ret = [][]string{}
+	for _, name := range q.names() {
+		var quota = q.quotas[name]
+		var state, exists = q.states[name]
+		if quota.Action == "" || !exists || !state.Exceeded {
+			continue
+		}
+		var comment = []string{"-m", "comment", "--comment", fmt.Sprintf("quota: %s", name)}
+		var limit, _ = iptablesLimit(quota.RateLimit)
+		for _, deviceName := range quota.Devices {
+			var device, known = inventory[deviceName]
+			if !known {
+				q.logger.Printf("device %s of quota %s is not in the inventory", deviceName, name)
+				continue
+			}
+			var addresses, bits = device.Ipv4, 32
+			if manager.ipv6 {
+				addresses, bits = device.Ipv6, 128
+			}
+			for _, address := range addresses {
+				var cidr = fmt.Sprintf("%s/%d", net.ParseIP(address).String(), bits)
+				for _, match := range [][]string{{"-s", cidr}, {"-d", cidr}} {
+					var rule = append(append([]string{}, match...), comment...)
+					if quota.Action == quotaActionRateLimit {
+						var limitRule = append(append([]string{}, rule...), "-m", "limit", "--limit", limit)
+						if quota.RateLimitBurst > 0 && quota.RateLimitBurst != 5 {
+							limitRule = append(limitRule, "--limit-burst", fmt.Sprint(quota.RateLimitBurst))
+						}
+						ret = append(ret, append(limitRule, "-j", "RETURN"))
+					}
+					ret = append(ret, append(rule, "-j", "DROP"))
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// enforce reconciles the quota chain on every tick, so the rules come back
+// when they are flushed and go away when a period resets
+func (q *usageQuotas) enforce() {
+	var inventory, err = loadInventory(q.inventoryFile)
+	if err != nil {
+		q.logger.Printf("failed to load inventory for quota enforcement: %s", err)
+		q.lock.Lock()
+		q.lastEnforceError = err
+		q.lock.Unlock()
+		return
+	}
+	for _, manager := range q.managers {
+		q.lock.Lock()
+		var desired = q.desiredRules(manager, inventory)
+		q.lock.Unlock()
+		if _, err = manager.reconcile(desired); err != nil {
+			q.logger.Printf("failed to enforce quotas with %s: %s", manager.command, err)
+			break
+		}
+	}
+	q.lock.Lock()
+	q.lastEnforceError = err
+	q.lock.Unlock()
+}
+
+func (q *usageQuotas) HandleQuotas(rw http.ResponseWriter, req *http.Request) {
+	var now = time.Now()
+	q.lock.Lock()
+	var statuses = []QuotaStatus{}
+	for _, name := range q.names() {
+		var quota = q.quotas[name]
+		var state = q.currentState(name, quota, now)
+		statuses = append(statuses, QuotaStatus{
+			Name:       name,
+			Quota:      quota,
+			QuotaState: state,
+			PeriodEnd:  periodEnd(quota, state.PeriodStart),
+			Percent:    state.UsedBytes / quota.LimitBytes * 100,
+			Enforced:   state.Exceeded && quota.Action != "" && q.lastEnforceError == nil,
+		})
+	}
+	var lastEnforceError = q.lastEnforceError
+	q.lock.Unlock()
+
+	var response = map[string]interface{}{"quotas": statuses}
+	if lastEnforceError != nil {
+		response["enforceError"] = lastEnforceError.Error()
+	}
+	writeJson(rw, http.StatusOK, response)
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func formatBytes(bytes float64) string {
+	var units = []string{"B", "KB", "MB", "GB", "TB"}
+	var i = 0
+	for bytes >= 1000 && i < len(units)-1 {
+		bytes /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", bytes, units[i])
+}
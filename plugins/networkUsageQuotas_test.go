@@ -0,0 +1,59 @@
+package plugins
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandleQuotasLeavesStateAlone(t *testing.T) {
+	var now = time.Now()
+	var quota = Quota{Devices: []string{"tv"}, Period: quotaPeriodDaily, LimitBytes: 1000, Action: quotaActionDrop}
+	var lastPeriod = periodStart(quota, now).AddDate(0, 0, -1)
+	var q = &usageQuotas{
+		logger: log.New(ioutil.Discard, "", 0),
+		quotas: map[string]Quota{"tv": quota},
+		states: map[string]*QuotaState{"tv": {PeriodStart: lastPeriod, UsedBytes: 2000, Warned: []int{}, Exceeded: true}},
+	}
+	var recorder = httptest.NewRecorder()
+	q.HandleQuotas(recorder, httptest.NewRequest(http.MethodGet, "/quotas", nil))
+	var response struct {
+		Quotas []QuotaStatus `json:"quotas"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Quotas) != 1 || response.Quotas[0].UsedBytes != 0 || response.Quotas[0].Enforced ||
+		!response.Quotas[0].PeriodStart.Equal(periodStart(quota, now)) {
+		t.Errorf("expected the view of a fresh period, got %+v", response.Quotas)
+	}
+	// the period is only started by the next tick, which logs the usage of the last one
+	var state = q.states["tv"]
+	if !state.PeriodStart.Equal(lastPeriod) || state.UsedBytes != 2000 || !state.Exceeded {
+		t.Errorf("the state was changed by a GET: %+v", state)
+	}
+}
+
+func TestValidateQuotaResetDay(t *testing.T) {
+	var tests = []struct {
+		period   string
+		resetDay int
+		valid    bool
+	}{
+		{quotaPeriodMonthly, 0, true},
+		{quotaPeriodMonthly, 28, true},
+		{quotaPeriodMonthly, 29, false},
+		{quotaPeriodWeekly, 6, true},
+		{quotaPeriodWeekly, 7, false},
+	}
+	for _, test := range tests {
+		var err = validateQuota(Quota{Devices: []string{"tv"}, Period: test.period, ResetDay: test.resetDay, LimitBytes: 1})
+		if (err == nil) != test.valid {
+			t.Errorf("%s reset day %d: got error %v, want valid %t", test.period, test.resetDay, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// live bandwidth, the counters are sampled every RATE_INTERVAL_IN_SECONDS (off
+// by default, as every sample runs the backend) apart from the slower ticks of
+// the cumulative metrics, exported as bytes per second gauges, and /top ranks
+// the devices over a window of 1m, 5m or 1h
+
+package plugins
+
+import (
+	"fmt"
+	"garfield/rpi-api-server/utils"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const networkUsageRateMetricName = "network_usage_monitor_rate_bytes_per_second"
+
+var rateWindows = map[string]time.Duration{
+	"1m": time.Minute,
+	"5m": 5 * time.Minute,
+	"1h": time.Hour,
+}
+
+const rateRetention = time.Hour
+
+// rateSample holds the bytes of every counter between two reads
+type rateSample struct {
+	start time.Time
+	end   time.Time
+	bytes map[usageKey]float64
+}
+
+type usageRates struct {
+	interval  time.Duration
+	backend   usageBackend
+	logger    *log.Logger
+	gaugeVec  *prometheus.GaugeVec
+	lock      sync.Mutex
+	last      map[usageKey]DeviceUsage
+	lastAt    time.Time
+	samples   []rateSample
+	lastError error
+}
+
+type TopDevice struct {
+	Device string `json:"device"`
+	// averages over the window
+	BytesPerSecond     float64 `json:"bytesPerSecond"`
+	UpBytesPerSecond   float64 `json:"upBytesPerSecond"`
+	DownBytesPerSecond float64 `json:"downBytesPerSecond"`
+	// of the last sample
+	CurrentBytesPerSecond float64 `json:"currentBytesPerSecond"`
+}
+
+type TopReport struct {
+	Window          string      `json:"window"`
+	CoveredSeconds  float64     `json:"coveredSeconds"`
+	IntervalSeconds float64     `json:"intervalSeconds"`
+	Devices         []TopDevice `json:"devices"`
+}
+
+// newUsageRates returns nil when RATE_INTERVAL_IN_SECONDS is 0
+func newUsageRates(backend usageBackend, logger *log.Logger) *usageRates {
+	var intervalInSeconds = utils.GetEnvVarInt("RATE_INTERVAL_IN_SECONDS", 0)
+	logger.Printf("RATE_INTERVAL_IN_SECONDS: %d", intervalInSeconds)
+	if intervalInSeconds <= 0 {
+		return nil
+	}
+	return &usageRates{
+		interval: time.Duration(intervalInSeconds) * time.Second,
+		backend:  backend,
+		logger:   logger,
+		gaugeVec: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: networkUsageRateMetricName,
+			Help: "bytes per second of devices over the last sample interval",
+		}, []string{deviceNameLabel, directionLabel}),
+	}
+}
+
+func (r *usageRates) sampling() {
+	var ticker = time.NewTicker(r.interval)
+	for now := time.Now(); true; now = <-ticker.C {
+		var usage, _, _, err = r.backend.ReadUsage()
+		r.lock.Lock()
+		r.lastError = err
+		if err != nil {
+			r.logger.Printf("failed to sample usage: %s", err)
+		} else {
+			r.add(usage, now)
+		}
+		r.lock.Unlock()
+	}
+}
+
+// add expects the lock to be held
+func (r *usageRates) add(usage map[usageKey]DeviceUsage, now time.Time) {
+	if r.last != nil {
+		var sample = rateSample{start: r.lastAt, end: now, bytes: map[usageKey]float64{}}
+		var seconds = now.Sub(r.lastAt).Seconds()
+		// the families of a device are merged after taking the differences, a
+		// new counter holds all its bytes so far and is only a starting point
+		for key, current := range usage {
+			var last, exists = r.last[key]
+			if !exists {
+				continue
+			}
+			var bytes = current.Bytes
+			if !isCounterReset(last, current) {
+				bytes = current.Bytes - last.Bytes
+			}
+			key.Family = ""
+			sample.bytes[key] += bytes
+		}
+		for key, bytes := range sample.bytes {
+			r.gaugeVec.WithLabelValues(key.Device, key.Direction).Set(bytes / seconds)
+		}
+		for key := range mergeFamilies(r.last) {
+			if _, exists := sample.bytes[key]; !exists {
+				r.gaugeVec.DeleteLabelValues(key.Device, key.Direction)
+			}
+		}
+		r.samples = append(r.samples, sample)
+	}
+	r.last, r.lastAt = usage, now
+	var keep = 0
+	for keep < len(r.samples) && now.Sub(r.samples[keep].end) > rateRetention {
+		keep++
+	}
+	r.samples = r.samples[keep:]
+}
+
+// top expects the lock to be held
+func (r *usageRates) top(window time.Duration, now time.Time) TopReport {
+	var report = TopReport{IntervalSeconds: r.interval.Seconds(), Devices: []TopDevice{}}
+	var devices = map[string]*TopDevice{}
+	var device = func(name string) *TopDevice {
+		if devices[name] == nil {
+			devices[name] = &TopDevice{Device: name}
+		}
+		return devices[name]
+	}
+	for _, sample := range r.samples {
+		if now.Sub(sample.end) > window {
+			continue
+		}
+		report.CoveredSeconds += sample.end.Sub(sample.start).Seconds()
+		for key, bytes := range sample.bytes {
+			switch key.Direction {
+			case directionUp:
+				device(key.Device).UpBytesPerSecond += bytes
+			case directionDown:
+				device(key.Device).DownBytesPerSecond += bytes
+			}
+			device(key.Device).BytesPerSecond += bytes
+		}
+	}
+	if len(r.samples) > 0 {
+		var last = r.samples[len(r.samples)-1]
+		var seconds = last.end.Sub(last.start).Seconds()
+		for key, bytes := range last.bytes {
+			device(key.Device).CurrentBytesPerSecond += bytes / seconds
+		}
+	}
+	for _, value := range devices {
+		if report.CoveredSeconds > 0 {
+			value.BytesPerSecond /= report.CoveredSeconds
+			value.UpBytesPerSecond /= report.CoveredSeconds
+			value.DownBytesPerSecond /= report.CoveredSeconds
+		}
+		report.Devices = append(report.Devices, *value)
+	}
+	sort.Slice(report.Devices, func(i, j int) bool {
+		if report.Devices[i].BytesPerSecond != report.Devices[j].BytesPerSecond {
+			return report.Devices[i].BytesPerSecond > report.Devices[j].BytesPerSecond
+		}
+		return report.Devices[i].Device < report.Devices[j].Device
+	})
+	return report
+}
+
+// HandleTop serves /top?window=5m&limit=10, the window defaults to 1m
+func (r *usageRates) HandleTop(rw http.ResponseWriter, req *http.Request) {
+	var queries = req.URL.Query()
+	var windowName = queries.Get("window")
+	if windowName == "" {
+		windowName = "1m"
+	}
+	var window, exists = rateWindows[windowName]
+	if !exists {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("invalid window %q, expecting 1m, 5m or 1h", windowName))
+		return
+	}
+	var limit = 0
+	if queries.Get("limit") != "" {
+		var err error
+		if limit, err = strconv.Atoi(queries.Get("limit")); err != nil || limit < 0 {
+			writeError(rw, http.StatusBadRequest, fmt.Errorf("invalid limit %q", queries.Get("limit")))
+			return
+		}
+	}
+
+	r.lock.Lock()
+	var report = r.top(window, time.Now())
+	var lastError = r.lastError
+	r.lock.Unlock()
+
+	if lastError != nil && len(report.Devices) == 0 {
+		writeError(rw, http.StatusServiceUnavailable, fmt.Errorf("failed to sample usage: %s", lastError))
+		return
+	}
+	report.Window = windowName
+	if limit > 0 && limit < len(report.Devices) {
+		report.Devices = report.Devices[:limit]
+	}
+	writeJson(rw, http.StatusOK, report)
+}
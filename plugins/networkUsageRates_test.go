@@ -0,0 +1,39 @@
+package plugins
+
+import (
+	"io/ioutil"
+	"log"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRatesSkipNewCounters(t *testing.T) {
+	var r = &usageRates{
+		interval: 10 * time.Second,
+		logger:   log.New(ioutil.Discard, "", 0),
+		gaugeVec: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_rate"}, []string{deviceNameLabel, directionLabel}),
+	}
+	var tvUp4 = usageKey{Device: "tv", Direction: directionUp, Family: familyIpv4}
+	var tvUp6 = usageKey{Device: "tv", Direction: directionUp, Family: familyIpv6}
+	var pcUp = usageKey{Device: "pc", Direction: directionUp, Family: familyIpv4}
+	var start = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.add(map[usageKey]DeviceUsage{tvUp4: {Bytes: 1e9}}, start)
+	// pc shows up with a counter of months and the ipv6 rule of tv is new
+	r.add(map[usageKey]DeviceUsage{tvUp4: {Bytes: 1e9 + 1000}, tvUp6: {Bytes: 5e9}, pcUp: {Bytes: 7e9}}, start.Add(10*time.Second))
+	// the tv counter was reset, it counts from 0 since
+	r.add(map[usageKey]DeviceUsage{tvUp4: {Bytes: 300}, tvUp6: {Bytes: 5e9 + 200}, pcUp: {Bytes: 7e9 + 500}}, start.Add(20*time.Second))
+
+	var report = r.top(time.Minute, start.Add(20*time.Second))
+	var want = map[string]float64{"tv": (1000 + 300 + 200) / 20.0, "pc": 500 / 20.0}
+	if len(report.Devices) != len(want) {
+		t.Fatalf("got %+v, want %v", report.Devices, want)
+	}
+	for _, device := range report.Devices {
+		if math.Abs(device.BytesPerSecond-want[device.Device]) > 1e-9 {
+			t.Errorf("%s: got %f bytes per second, want %f", device.Device, device.BytesPerSecond, want[device.Device])
+		}
+	}
+}
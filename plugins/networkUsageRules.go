@@ -0,0 +1,296 @@
+// optionally own the accounting chain, with INVENTORY_FILE set the chain is
+// created, hooked into FORWARD and its rules are reconciled with the devices
+// on every tick, the inventory is read again each time so edits apply on the
+// next tick, it looks like
+//
+//	{
+//	    "tv": {"mac": "aa:bb:cc:dd:ee:ff", "ipv4": ["192.168.1.10"], "ipv6": ["fd00::10"]},
+//	    "phone": {"mac": "aa:bb:cc:dd:ee:00"}
+//	}
+//
+// every address gets an up rule matching its source and a down rule matching
+// its destination, a mac can only match the source, so it is only used for an
+// up rule of a device without ipv4 addresses, ipv6 rules go to ip6tables
+// when IPV6_ACCOUNTING is set
+// with RULES_DRY_RUN the planned commands are only logged
+
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"garfield/rpi-api-server/utils"
+	"io/ioutil"
+	"log"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type InventoryDevice struct {
+	Mac  string   `json:"mac,omitempty"`
+	Ipv4 []string `json:"ipv4,omitempty"`
+	Ipv6 []string `json:"ipv6,omitempty"`
+}
+
+var deviceNamePattern = regexp.MustCompile(`^[^\s/]+$`)
+
+func loadInventory(filePath string) (map[string]InventoryDevice, error) {
+	var jsonBytes, err = ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var inventory = map[string]InventoryDevice{}
+	if err = json.Unmarshal(jsonBytes, &inventory); err != nil {
+		return nil, err
+	}
+	for name, device := range inventory {
+		if err = validateInventoryDevice(name, device); err != nil {
+			return nil, fmt.Errorf("device %s is invalid: %s", name, err)
+		}
+	}
+	return inventory, nil
+}
+
+// inventoryAddresses maps the normalized ips and macs of the devices to their names
+func inventoryAddresses(inventory map[string]InventoryDevice) (map[string]string, map[string]string) {
+	var byIp, byMac = map[string]string{}, map[string]string{}
+	for name, device := range inventory {
+		if mac, err := net.ParseMAC(device.Mac); err == nil {
+			byMac[mac.String()] = name
+		}
+		for _, address := range append(append([]string{}, device.Ipv4...), device.Ipv6...) {
+			byIp[net.ParseIP(address).String()] = name
+		}
+	}
+	return byIp, byMac
+}
+
+// validateInventoryDevice rejects names the comment convention can not carry
+func validateInventoryDevice(name string, device InventoryDevice) error {
+	if !deviceNamePattern.MatchString(name) {
+		return fmt.Errorf("name must not be empty or contain spaces or slashes")
+	}
+	if device.Mac != "" {
+		if _, err := net.ParseMAC(device.Mac); err != nil {
+			return err
+		}
+	}
+	for _, address := range device.Ipv4 {
+		if ip := net.ParseIP(address); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid ipv4 address %q", address)
+		}
+	}
+	for _, address := range device.Ipv6 {
+		if ip := net.ParseIP(address); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid ipv6 address %q", address)
+		}
+	}
+	if device.Mac == "" && len(device.Ipv4) == 0 && len(device.Ipv6) == 0 {
+		return fmt.Errorf("no mac or address")
+	}
+	return nil
+}
+
+// ruleManager reconciles the chain of one ip family
+type ruleManager struct {
+	command      string
+	ipv6         bool
+	chainName    string
+	parentChain  string
+	commentKey   string
+	directionKey string
+	dryRun       bool
+	// rules of an order sensitive chain are flushed and appended again on any difference
+	rebuild bool
+	run     commandRunner
+	logger  *log.Logger
+}
+
+// newRuleManagers returns the manager of ip6tables after the one of iptables
+// when ipv6 is set, the chain of ip6tables is left alone otherwise
+func newRuleManagers(chainName string, commentKey string, directionKey string, ipv6 bool, run commandRunner, logger *log.Logger) []*ruleManager {
+	var template = ruleManager{
+		chainName:    chainName,
+		parentChain:  utils.GetEnvVarString("PARENT_CHAIN", "FORWARD"),
+		commentKey:   commentKey,
+		directionKey: directionKey,
+		dryRun:       utils.GetEnvVarBool("RULES_DRY_RUN", false),
+		run:          run,
+		logger:       logger,
+	}
+	var ipv4 = template
+	ipv4.command = utils.GetEnvVarString("IPTABLES_COMMAND", "iptables")
+	if !ipv6 {
+		return []*ruleManager{&ipv4}
+	}
+	var ipv6Manager = template
+	ipv6Manager.command = utils.GetEnvVarString("IP6TABLES_COMMAND", "ip6tables")
+	ipv6Manager.ipv6 = true
+	return []*ruleManager{&ipv4, &ipv6Manager}
+}
+
+func (m *ruleManager) comment(name string, direction string) string {
+	return fmt.Sprintf("%s: %s %s: %s", m.commentKey, name, m.directionKey, direction)
+}
+
+// desiredRules returns the rule specs in the form `iptables -S` prints them,
+// so they can be compared with the existing rules as they are
+func (m *ruleManager) desiredRules(inventory map[string]InventoryDevice) [][]string {
+	var ret = [][]string{}
+	for _, name := range sortedKeys(inventory) {
+		var device = inventory[name]
+		var addresses, bits = device.Ipv4, 32
+		if m.ipv6 {
+			addresses, bits = device.Ipv6, 128
+		}
+		if !m.ipv6 && len(addresses) == 0 && device.Mac != "" {
+			var mac, _ = net.ParseMAC(device.Mac)
+			ret = append(ret, []string{"-m", "mac", "--mac-source", strings.ToUpper(mac.String()),
+				"-m", "comment", "--comment", m.comment(name, directionUp)})
+		}
+		for _, address := range addresses {
+			var cidr = fmt.Sprintf("%s/%d", net.ParseIP(address).String(), bits)
+			ret = append(ret, []string{"-s", cidr, "-m", "comment", "--comment", m.comment(name, directionUp)})
+			ret = append(ret, []string{"-d", cidr, "-m", "comment", "--comment", m.comment(name, directionDown)})
+		}
+	}
+	return ret
+}
+
+func sortedKeys(inventory map[string]InventoryDevice) []string {
+	var ret = []string{}
+	for name := range inventory {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// existingRules returns nil when the chain does not exist
+func (m *ruleManager) existingRules() ([][]string, error) {
+	var stdout, stderr, err = m.run(m.command, "-S", m.chainName)
+	if err != nil {
+		if strings.Contains(string(stderr), "No chain") || strings.Contains(string(stderr), "does not exist") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s -S %s: %s, stderr: %q", m.command, m.chainName, err, stderr)
+	}
+	var ret = [][]string{}
+	for _, line := range strings.Split(string(stdout), "\n") {
+		var args = splitArgs(line)
+		if len(args) < 2 || args[0] != "-A" || args[1] != m.chainName {
+			continue
+		}
+		ret = append(ret, args[2:])
+	}
+	return ret, nil
+}
+
+func (m *ruleManager) isHooked() bool {
+	var _, _, err = m.run(m.command, "-C", m.parentChain, "-j", m.chainName)
+	return err == nil
+}
+
+// plan returns the commands that bring the chain to the desired rules, other
+// rules are deleted as the chain is owned by us
+func (m *ruleManager) plan(desired [][]string) ([][]string, error) {
+	var existing, err = m.existingRules()
+	if err != nil && m.dryRun {
+		// like not being root, plan as if the chain did not exist
+		m.logger.Printf("dry run planned against an empty chain: %s", err)
+		existing, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ret = [][]string{}
+	// like no ipv6 addresses in the inventory, the chain is not needed
+	if existing == nil && len(desired) == 0 {
+		return ret, nil
+	}
+	if existing == nil {
+		ret = append(ret, []string{"-N", m.chainName})
+	}
+	if existing == nil || !m.isHooked() {
+		ret = append(ret, []string{"-I", m.parentChain, "-j", m.chainName})
+	}
+	if m.rebuild {
+		if sameRules(existing, desired) {
+			return ret, nil
+		}
+		if len(existing) > 0 {
+			ret = append(ret, []string{"-F", m.chainName})
+		}
+		for _, rule := range desired {
+			ret = append(ret, append([]string{"-A", m.chainName}, rule...))
+		}
+		return ret, nil
+	}
+	var desiredSet = map[string]bool{}
+	for _, rule := range desired {
+		desiredSet[strings.Join(rule, "\x00")] = true
+	}
+	var existingSet = map[string]bool{}
+	for _, rule := range existing {
+		var key = strings.Join(rule, "\x00")
+		if !desiredSet[key] || existingSet[key] {
+			ret = append(ret, append([]string{"-D", m.chainName}, rule...))
+			continue
+		}
+		existingSet[key] = true
+	}
+	for _, rule := range desired {
+		if !existingSet[strings.Join(rule, "\x00")] {
+			ret = append(ret, append([]string{"-A", m.chainName}, rule...))
+		}
+	}
+	return ret, nil
+}
+
+// reconcile runs the planned commands, or only logs them in dry run, and
+// returns them formatted like a shell command
+func (m *ruleManager) reconcile(desired [][]string) ([]string, error) {
+	var commands, err = m.plan(desired)
+	if err != nil {
+		return nil, err
+	}
+	var ret = []string{}
+	for _, args := range commands {
+		var formatted = formatCommand(m.command, args)
+		ret = append(ret, formatted)
+		if m.dryRun {
+			m.logger.Printf("dry run: %s", formatted)
+			continue
+		}
+		m.logger.Printf("running: %s", formatted)
+		if _, stderr, err := m.run(m.command, args...); err != nil {
+			return ret, fmt.Errorf("%s: %s, stderr: %q", formatted, err, stderr)
+		}
+	}
+	return ret, nil
+}
+
+func sameRules(a [][]string, b [][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if strings.Join(a[i], "\x00") != strings.Join(b[i], "\x00") {
+			return false
+		}
+	}
+	return true
+}
+
+func formatCommand(name string, args []string) string {
+	var parts = []string{name}
+	for _, arg := range args {
+		if strings.ContainsAny(arg, " \t\"") {
+			arg = fmt.Sprintf("%q", arg)
+		}
+		parts = append(parts, arg)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,194 @@
+package plugins
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeIptables keeps one chain in the form `iptables -S` prints it and applies
+// the commands of a ruleManager to it, every call is recorded
+type fakeIptables struct {
+	exists bool
+	hooked bool
+	lines  []string
+	calls  [][]string
+}
+
+func (f *fakeIptables) run(name string, args ...string) ([]byte, []byte, error) {
+	f.calls = append(f.calls, args)
+	var failed = errors.New("exit status 1")
+	if args[0] != "-N" && args[0] != "-I" && args[0] != "-C" && !f.exists {
+		return nil, []byte("iptables: No chain/target/match by that name.\n"), failed
+	}
+	switch args[0] {
+	case "-S":
+		return []byte("-N " + args[1] + "\n" + strings.Join(f.lines, "\n") + "\n"), nil, nil
+	case "-C":
+		if !f.hooked {
+			return nil, []byte("iptables: Bad rule (does a matching rule exist in that chain?).\n"), failed
+		}
+	case "-N":
+		f.exists = true
+	case "-I":
+		f.hooked = true
+	case "-F":
+		f.lines = nil
+	case "-A":
+		f.lines = append(f.lines, formatCommand(args[0], args[1:]))
+	case "-D":
+		var line = formatCommand("-A", args[1:])
+		for i := range f.lines {
+			if f.lines[i] == line {
+				f.lines = append(f.lines[:i], f.lines[i+1:]...)
+				return nil, nil, nil
+			}
+		}
+		return nil, []byte("iptables: Bad rule (does a matching rule exist in that chain?).\n"), failed
+	}
+	return nil, nil, nil
+}
+
+var rulesInventory = map[string]InventoryDevice{
+	"tv":    {Mac: "aa:bb:cc:00:00:01", Ipv4: []string{"192.168.1.10"}, Ipv6: []string{"fd00::10"}},
+	"phone": {Mac: "aa:bb:cc:00:00:02"},
+}
+
+// recorded from a chain with a duplicate up rule of tv, a rule of a device
+// that left the inventory and the rule of phone missing
+const recordedRules = `-A NETWORK-FILTER -s 192.168.1.10/32 -m comment --comment "device_name: tv dir: up"
+-A NETWORK-FILTER -s 192.168.1.10/32 -m comment --comment "device_name: tv dir: up"
+-A NETWORK-FILTER -s 192.168.1.99/32 -m comment --comment "device_name: old dir: up"
+-A NETWORK-FILTER -d 192.168.1.10/32 -m comment --comment "device_name: tv dir: down"`
+
+func newFakeRuleManager(fake *fakeIptables, dryRun bool) *ruleManager {
+	return &ruleManager{
+		command:      "iptables",
+		chainName:    "NETWORK-FILTER",
+		parentChain:  "FORWARD",
+		commentKey:   "device_name",
+		directionKey: "dir",
+		dryRun:       dryRun,
+		run:          fake.run,
+		logger:       log.New(ioutil.Discard, "", 0),
+	}
+}
+
+func TestReconcileCreatesChain(t *testing.T) {
+	var fake = &fakeIptables{}
+	var m = newFakeRuleManager(fake, false)
+	var commands, err = m.reconcile(m.desiredRules(rulesInventory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want = []string{
+		"iptables -N NETWORK-FILTER",
+		"iptables -I FORWARD -j NETWORK-FILTER",
+		`iptables -A NETWORK-FILTER -m mac --mac-source AA:BB:CC:00:00:02 -m comment --comment "device_name: phone dir: up"`,
+		`iptables -A NETWORK-FILTER -s 192.168.1.10/32 -m comment --comment "device_name: tv dir: up"`,
+		`iptables -A NETWORK-FILTER -d 192.168.1.10/32 -m comment --comment "device_name: tv dir: down"`,
+	}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("got %q\nwant %q", commands, want)
+	}
+
+	commands, err = m.reconcile(m.desiredRules(rulesInventory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 0 {
+		t.Errorf("expected no commands on the second reconcile, got %q", commands)
+	}
+}
+
+func TestReconcileDeletesStaleRules(t *testing.T) {
+	var fake = &fakeIptables{exists: true, lines: strings.Split(recordedRules, "\n")}
+	var m = newFakeRuleManager(fake, false)
+	var commands, err = m.reconcile(m.desiredRules(rulesInventory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want = []string{
+		"iptables -I FORWARD -j NETWORK-FILTER",
+		`iptables -D NETWORK-FILTER -s 192.168.1.10/32 -m comment --comment "device_name: tv dir: up"`,
+		`iptables -D NETWORK-FILTER -s 192.168.1.99/32 -m comment --comment "device_name: old dir: up"`,
+		`iptables -A NETWORK-FILTER -m mac --mac-source AA:BB:CC:00:00:02 -m comment --comment "device_name: phone dir: up"`,
+	}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("got %q\nwant %q", commands, want)
+	}
+	var existing, _ = m.existingRules()
+	if len(existing) != 3 || !fake.hooked {
+		t.Errorf("expected 3 hooked rules, got %q hooked %v", existing, fake.hooked)
+	}
+
+	commands, err = m.reconcile(m.desiredRules(rulesInventory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 0 {
+		t.Errorf("expected no commands on the second reconcile, got %q", commands)
+	}
+}
+
+func TestReconcileIpv6WithoutAddresses(t *testing.T) {
+	var fake = &fakeIptables{}
+	var m = newFakeRuleManager(fake, false)
+	m.ipv6 = true
+	var commands, err = m.reconcile(m.desiredRules(map[string]InventoryDevice{"phone": rulesInventory["phone"]}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 0 || fake.exists {
+		t.Errorf("expected the chain not to be created, got %q", commands)
+	}
+}
+
+func TestReconcileDryRun(t *testing.T) {
+	var fake = &fakeIptables{exists: true, lines: strings.Split(recordedRules, "\n")}
+	var m = newFakeRuleManager(fake, true)
+	var commands, err = m.reconcile(m.desiredRules(rulesInventory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 4 {
+		t.Errorf("expected the 4 planned commands, got %q", commands)
+	}
+	for _, call := range fake.calls {
+		if call[0] != "-S" && call[0] != "-C" {
+			t.Errorf("dry run ran %q", call)
+		}
+	}
+	if fake.hooked || len(fake.lines) != 4 {
+		t.Errorf("dry run changed the chain: hooked %v, %q", fake.hooked, fake.lines)
+	}
+}
+
+func TestReconcileDryRunWithoutRoot(t *testing.T) {
+	var m = newFakeRuleManager(&fakeIptables{}, true)
+	m.run = func(name string, args ...string) ([]byte, []byte, error) {
+		return nil, []byte("iptables v1.8.7 (nf_tables): Could not fetch rule set generation id: Permission denied (you must be root)\n"), errors.New("exit status 4")
+	}
+	var commands, err = m.reconcile(m.desiredRules(rulesInventory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 5 || commands[0] != "iptables -N NETWORK-FILTER" {
+		t.Errorf("expected a plan against an empty chain, got %q", commands)
+	}
+}
+
+func TestNewRuleManagersIpv6(t *testing.T) {
+	var logger = log.New(ioutil.Discard, "", 0)
+	var managers = newRuleManagers("NETWORK-FILTER", "device_name", "dir", false, nil, logger)
+	if len(managers) != 1 || managers[0].command != "iptables" || managers[0].ipv6 {
+		t.Errorf("got %+v, want only iptables without ipv6 accounting", managers)
+	}
+	managers = newRuleManagers("NETWORK-FILTER", "device_name", "dir", true, nil, logger)
+	if len(managers) != 2 || managers[1].command != "ip6tables" || !managers[1].ipv6 {
+		t.Errorf("got %+v, want iptables and ip6tables", managers)
+	}
+}
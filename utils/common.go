@@ -1,10 +1,14 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"syscall"
 )
 
 func GetLogger(name string) *log.Logger {
@@ -38,6 +42,39 @@ func GetEnvVarInt(name string, defaultValue int) int {
 	return ret
 }
 
+// WriteFileAtomically writes to a temporary file next to the target and renames
+// it over, keeping the mode of the target, a new file gets 0644
+func WriteFileAtomically(filePath string, content []byte) error {
+	var mode os.FileMode = 0644
+	if info, err := os.Stat(filePath); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(content); err == nil {
+		err = tmp.Chmod(mode)
+	}
+	// the content has to be on disk before the rename, or a power cut may leave an empty file
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), filePath)
+	if errors.Is(err, syscall.EBUSY) {
+		return fmt.Errorf("%s, %q is likely a bind mounted file, mount its directory instead", err, filePath)
+	}
+	return err
+}
+
 type NotificationPusher interface {
 	Send(title string, message string, priority int) error
 }
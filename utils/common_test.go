@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomically(t *testing.T) {
+	var dir = t.TempDir()
+	var filePath = filepath.Join(dir, "targets.json")
+	if err := WriteFileAtomically(filePath, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filePath); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("got %v and error %v, want a new file with mode 0644", info.Mode(), err)
+	}
+
+	if err := os.Chmod(filePath, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomically(filePath, []byte(`{"router": {}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filePath); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("got %v and error %v, want the mode 0640 to be kept", info.Mode(), err)
+	}
+	var content, _ = ioutil.ReadFile(filePath)
+	if string(content) != `{"router": {}}` {
+		t.Errorf("got %q", content)
+	}
+	var entries, _ = ioutil.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("expected the temporary file to be gone, got %d files", len(entries))
+	}
+}